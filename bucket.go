@@ -0,0 +1,63 @@
+package mallory
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// interval to drop full buckets of keys gone, e.g. clients and hosts
+	bucketSweepInterval = time.Minute
+)
+
+// token bucket refilled at rate per second up to size, tokens may be
+// negative for the debt taken
+type bucket struct {
+	rate   float64
+	size   float64
+	tokens float64
+	last   time.Time
+}
+
+// refill the bucket of rate and size since last time, a new one is full
+func (self *bucket) refill(rate, size float64, now time.Time) {
+	if self.last.IsZero() {
+		self.tokens = size
+	} else {
+		self.tokens = math.Min(size, self.tokens+now.Sub(self.last).Seconds()*rate)
+	}
+	self.rate, self.size, self.last = rate, size, now
+}
+
+// full once refilled
+func (self *bucket) full(now time.Time) bool {
+	return self.tokens+now.Sub(self.last).Seconds()*self.rate >= self.size
+}
+
+// token buckets by key, the full ones are dropped once in a while as they
+// are the same as new ones
+type buckets struct {
+	m     map[string]*bucket
+	swept time.Time
+}
+
+// get the bucket of key, created if not found
+func (self *buckets) get(key string, now time.Time) *bucket {
+	if now.Sub(self.swept) > bucketSweepInterval {
+		self.swept = now
+		for k, b := range self.m {
+			if b.full(now) {
+				delete(self.m, k)
+			}
+		}
+	}
+	b, ok := self.m[key]
+	if !ok {
+		if self.m == nil {
+			self.m = make(map[string]*bucket)
+		}
+		b = &bucket{}
+		self.m[key] = b
+	}
+	return b
+}
@@ -0,0 +1,54 @@
+package mallory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	var bs buckets
+	now := time.Now()
+	b := bs.get("a", now)
+	b.refill(10, 5, now)
+	if b.tokens != 5 {
+		t.Fatalf("new bucket of %g tokens, want full", b.tokens)
+	}
+	b.tokens = -5
+	// capped at the size once refilled
+	b.refill(10, 5, now.Add(time.Second/2))
+	if b.tokens != 0 {
+		t.Errorf("%g tokens after refilled for 0.5s, want 0", b.tokens)
+	}
+	b.refill(10, 5, now.Add(time.Hour))
+	if b.tokens != 5 {
+		t.Errorf("%g tokens after refilled for 1h, want 5", b.tokens)
+	}
+
+	// only the full ones are swept
+	later := now.Add(time.Hour)
+	c := bs.get("b", later)
+	c.refill(1, 1000, later)
+	c.tokens = 0
+	bs.get("c", later.Add(2*bucketSweepInterval))
+	if _, ok := bs.m["a"]; ok {
+		t.Errorf("full bucket is kept")
+	}
+	if _, ok := bs.m["b"]; !ok {
+		t.Errorf("bucket not full is dropped")
+	}
+}
+
+func TestTakeBytes(t *testing.T) {
+	var b bucket
+	now := time.Now()
+	if d := takeBytes(&b, 100, 100, now); d != 0 {
+		t.Errorf("wait %s for one second of rate", d)
+	}
+	if d := takeBytes(&b, 50, 100, now); d != time.Second/2 {
+		t.Errorf("wait %s for half a second of debt", d)
+	}
+	// the debt is limited
+	if d := takeBytes(&b, 1000, 100, now); d != shapeMaxDebt*time.Second {
+		t.Errorf("wait %s over the max debt", d)
+	}
+}
@@ -0,0 +1,662 @@
+package mallory
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// max lifetime of responses only have Last-Modified, RFC 7234 section 4.2.2
+	cacheHeuristicMax = 24 * time.Hour
+)
+
+var (
+	// caches opened by dir, servers in the same process share them
+	caches      = make(map[string]*Cache)
+	cachesMutex sync.Mutex
+)
+
+// status codes cacheable by default, RFC 7231 section 6.1
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// stored response, the body is in a file with the same name of the meta file
+type cacheEntry struct {
+	// URL of the request
+	URL string `json:"url"`
+	// values of request headers named by Vary
+	Vary map[string]string `json:"vary"`
+	// status code and header of the response
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	// time the request was sent and the response was received
+	RequestTime  time.Time `json:"request_time"`
+	ResponseTime time.Time `json:"response_time"`
+	// size of body
+	Size int64 `json:"size"`
+	// file name
+	name string
+	// element in LRU list
+	el *list.Element
+}
+
+// current age, RFC 7234 section 4.2.3
+func (self *cacheEntry) age(now time.Time) time.Duration {
+	date := self.date()
+	apparent := self.ResponseTime.Sub(date)
+	if apparent < 0 {
+		apparent = 0
+	}
+	age, _ := strconv.Atoi(self.Header.Get("Age"))
+	corrected := time.Duration(age)*time.Second + self.ResponseTime.Sub(self.RequestTime)
+	if corrected < apparent {
+		corrected = apparent
+	}
+	return corrected + now.Sub(self.ResponseTime)
+}
+
+// freshness lifetime, RFC 7234 section 4.2.1
+func (self *cacheEntry) lifetime() time.Duration {
+	cc := parseCacheControl(self.Header)
+	for _, k := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[k]; ok {
+			n, _ := strconv.Atoi(v)
+			return time.Duration(n) * time.Second
+		}
+	}
+	if v := self.Header.Get("Expires"); v != "" {
+		// invalid date means in the past
+		t, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(self.date())
+	}
+	if v := self.Header.Get("Last-Modified"); v != "" && cacheableStatus[self.Status] {
+		if t, err := http.ParseTime(v); err == nil {
+			d := self.date().Sub(t) / 10
+			if d > cacheHeuristicMax {
+				d = cacheHeuristicMax
+			}
+			return d
+		}
+	}
+	return 0
+}
+
+// Date of the response, or the time received
+func (self *cacheEntry) date() time.Time {
+	if t, err := http.ParseTime(self.Header.Get("Date")); err == nil {
+		return t
+	}
+	return self.ResponseTime
+}
+
+// whether the entry can be validated with the server
+func (self *cacheEntry) validatable() bool {
+	return self.Header.Get("ETag") != "" || self.Header.Get("Last-Modified") != ""
+}
+
+// Directives of Cache-Control in header, names are lower case
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range h["Cache-Control"] {
+		for _, d := range strings.Split(line, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			k, v := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				k, v = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(k))] = v
+		}
+	}
+	return cc
+}
+
+// names of request headers in Vary of h, canonical and sorted
+func varyNames(h http.Header) (names []string) {
+	for _, line := range h["Vary"] {
+		for _, k := range strings.Split(line, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				names = append(names, http.CanonicalHeaderKey(k))
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// On-disk cache of HTTP responses, RFC 7234.
+// It's a shared cache, responses to requests with Authorization, or with
+// private or Set-Cookie are not stored.
+type Cache struct {
+	// directory of files
+	Dir string
+	// max total size of bodies
+	MaxSize int64
+	// max size of a body
+	MaxObject int64
+	// file name to entry
+	entries map[string]*cacheEntry
+	// URL to request header names of the last Vary
+	vary map[string][]string
+	// least recently used at back
+	list  *list.List
+	size  int64
+	mutex sync.Mutex
+}
+
+// Open the cache in dir, load entries stored before
+func OpenCache(dir string, maxSize, maxObject int64) (self *Cache, err error) {
+	cachesMutex.Lock()
+	defer cachesMutex.Unlock()
+	if self = caches[dir]; self != nil {
+		return
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	self = &Cache{
+		Dir:       dir,
+		MaxSize:   maxSize,
+		MaxObject: maxObject,
+		entries:   make(map[string]*cacheEntry),
+		vary:      make(map[string][]string),
+		list:      list.New(),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var loaded []*cacheEntry
+	for _, fi := range files {
+		name := fi.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// left by the crashed writes
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		e := &cacheEntry{name: strings.TrimSuffix(name, ".json")}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			err = json.Unmarshal(buf, e)
+		}
+		if err != nil {
+			self.removeFiles(e.name)
+			continue
+		}
+		loaded = append(loaded, e)
+	}
+	// assume the recently stored ones are recently used
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].ResponseTime.After(loaded[j].ResponseTime)
+	})
+	for _, e := range loaded {
+		self.add(e)
+	}
+	self.evict()
+	caches[dir] = self
+	return
+}
+
+// file name of the request to url with the values of vary headers
+func cacheName(url string, vary map[string]string) string {
+	h := sha256.New()
+	io.WriteString(h, url)
+	names := make([]string, 0, len(vary))
+	for k := range vary {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		io.WriteString(h, "\n"+k+": "+vary[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// values of request headers in names
+func varyValues(r *http.Request, names []string) map[string]string {
+	vary := make(map[string]string, len(names))
+	for _, k := range names {
+		vary[k] = strings.Join(r.Header[k], ", ")
+	}
+	return vary
+}
+
+func (self *Cache) add(e *cacheEntry) {
+	self.entries[e.name] = e
+	self.vary[e.URL] = varyNames(e.Header)
+	e.el = self.list.PushFront(e)
+	self.size += e.Size
+}
+
+func (self *Cache) remove(e *cacheEntry) {
+	if self.entries[e.name] != e {
+		return
+	}
+	delete(self.entries, e.name)
+	self.list.Remove(e.el)
+	self.size -= e.Size
+	self.removeFiles(e.name)
+}
+
+func (self *Cache) removeFiles(name string) {
+	os.Remove(filepath.Join(self.Dir, name))
+	os.Remove(filepath.Join(self.Dir, name+".json"))
+}
+
+// drop the least recently used entries until the size fits
+func (self *Cache) evict() {
+	for self.size > self.MaxSize && self.list.Len() > 0 {
+		self.remove(self.list.Back().Value.(*cacheEntry))
+	}
+}
+
+// get the entry for request r
+func (self *Cache) get(r *http.Request) *cacheEntry {
+	url := r.URL.String()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	e := self.entries[cacheName(url, varyValues(r, self.vary[url]))]
+	if e != nil {
+		self.list.MoveToFront(e.el)
+	}
+	return e
+}
+
+// Remove stored responses of url, e.g. after an unsafe request, RFC 7234 section 4.4
+func (self *Cache) Invalidate(url string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, e := range self.entries {
+		if e.URL == url {
+			self.remove(e)
+		}
+	}
+}
+
+// save meta of entry, and the body in tmp file if not empty
+func (self *Cache) store(e *cacheEntry, tmp string) error {
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(self.Dir, e.name)
+	if err = ioutil.WriteFile(path+".json.tmp", meta, 0600); err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	old := self.entries[e.name]
+	if old == nil && tmp == "" {
+		// the body has been evicted
+		os.Remove(path + ".json.tmp")
+		return errors.New("cache entry evicted")
+	}
+	if old != nil {
+		delete(self.entries, old.name)
+		self.list.Remove(old.el)
+		self.size -= old.Size
+	}
+	if tmp != "" {
+		if err = os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(path+".json.tmp", path+".json"); err != nil {
+		return err
+	}
+	self.add(e)
+	self.evict()
+	return nil
+}
+
+// Serve r from cache, or by fetch and store the response if cacheable
+func (self *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, fetch func(w http.ResponseWriter, r *http.Request) error) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		// unsafe methods may change the resource
+		err := fetch(w, r)
+		if err == nil && r.Method != "OPTIONS" && r.Method != "TRACE" {
+			self.Invalidate(r.URL.String())
+		}
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header)
+	if _, ok := reqCC["no-store"]; ok || r.Header.Get("Range") != "" {
+		fetch(w, r)
+		return
+	}
+
+	e := self.get(r)
+	if e != nil && self.fresh(e, r, reqCC) {
+		if self.serve(w, r, e) {
+			L.Printf("CACHE HIT %s\n", r.URL)
+			return
+		}
+		e = nil
+	}
+	if _, ok := reqCC["only-if-cached"]; ok {
+		L.Printf("CACHE MISS %s\n", r.URL)
+		http.Error(w, "not cached", http.StatusGatewayTimeout)
+		return
+	}
+	if e != nil && !e.validatable() {
+		e = nil
+	}
+
+	// validate the stored response by conditional request
+	req := r
+	if e != nil {
+		req = r.Clone(r.Context())
+		req.Header.Del("If-Modified-Since")
+		req.Header.Del("If-None-Match")
+		if etag := e.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lm := e.Header.Get("Last-Modified"); lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	cw := &cacheWriter{ResponseWriter: w, cache: self, r: r, entry: e, start: time.Now()}
+	err := fetch(cw, req)
+	if cw.notModified {
+		cw.revalidated()
+		if self.serve(w, r, cw.entry) {
+			L.Printf("CACHE REVALIDATED %s\n", r.URL)
+		} else {
+			fetch(w, r)
+		}
+		return
+	}
+	cw.finish(err)
+	if cw.stored {
+		L.Printf("CACHE MISS %s, stored\n", r.URL)
+	} else {
+		L.Printf("CACHE MISS %s\n", r.URL)
+	}
+}
+
+// whether the entry can be served for r without validation, RFC 7234 section 4.2
+func (self *Cache) fresh(e *cacheEntry, r *http.Request, reqCC map[string]string) bool {
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	if _, ok := reqCC["max-age"]; !ok && r.Header.Get("Cache-Control") == "" &&
+		strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache") {
+		return false
+	}
+	cc := parseCacheControl(e.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	}
+
+	age, lifetime := e.age(time.Now()), e.lifetime()
+	if v, ok := reqCC["max-age"]; ok {
+		n, _ := strconv.Atoi(v)
+		if age > time.Duration(n)*time.Second {
+			return false
+		}
+	}
+	if v, ok := reqCC["min-fresh"]; ok {
+		n, _ := strconv.Atoi(v)
+		age += time.Duration(n) * time.Second
+	}
+	if age < lifetime {
+		return true
+	}
+
+	// stale responses are only served if the client accepts
+	_, mustRevalidate := cc["must-revalidate"]
+	_, proxyRevalidate := cc["proxy-revalidate"]
+	_, sMaxAge := cc["s-maxage"]
+	v, ok := reqCC["max-stale"]
+	if !ok || mustRevalidate || proxyRevalidate || sMaxAge {
+		return false
+	}
+	if v == "" {
+		return true
+	}
+	n, _ := strconv.Atoi(v)
+	return age-lifetime < time.Duration(n)*time.Second
+}
+
+// write the stored response to w, returns false if nothing is written
+func (self *Cache) serve(w http.ResponseWriter, r *http.Request, e *cacheEntry) bool {
+	f, err := os.Open(filepath.Join(self.Dir, e.name))
+	if err != nil {
+		L.Printf("CACHE Open: %s\n", err)
+		self.mutex.Lock()
+		self.remove(e)
+		self.mutex.Unlock()
+		return false
+	}
+	defer f.Close()
+
+	h := w.Header()
+	for k := range h {
+		h.Del(k)
+	}
+	for k, vs := range e.Header {
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Set("Age", strconv.Itoa(int(e.age(time.Now())/time.Second)))
+
+	if e.Status == http.StatusOK && notModified(r, e.Header) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	h.Set("Content-Length", strconv.FormatInt(e.Size, 10))
+	w.WriteHeader(e.Status)
+	if r.Method != "HEAD" {
+		if _, err = io.Copy(w, f); err != nil {
+			L.Printf("Copy: %s\n", err.Error())
+		}
+	}
+	return true
+}
+
+// evaluate the conditional request r against the response header, RFC 7232 section 6
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// pass the response to client and tee the body to a temp file if cacheable
+type cacheWriter struct {
+	http.ResponseWriter
+	cache *Cache
+	// original request from client
+	r *http.Request
+	// the entry in validation, nil if none
+	entry *cacheEntry
+	start time.Time
+	// response of the entry
+	next *cacheEntry
+	file *os.File
+	// 304 of the conditional request
+	notModified bool
+	wrote       bool
+	stored      bool
+}
+
+func (self *cacheWriter) WriteHeader(code int) {
+	if self.wrote || code < 200 {
+		self.ResponseWriter.WriteHeader(code)
+		return
+	}
+	self.wrote = true
+	h := self.Header()
+	if self.entry != nil && code == http.StatusNotModified {
+		self.notModified = true
+		self.next = &cacheEntry{Header: h.Clone()}
+		return
+	}
+	if self.cacheable(code, h) {
+		self.next = &cacheEntry{
+			URL:          self.r.URL.String(),
+			Vary:         varyValues(self.r, varyNames(h)),
+			Status:       code,
+			Header:       h.Clone(),
+			RequestTime:  self.start,
+			ResponseTime: time.Now(),
+		}
+		RemoveHopHeaders(self.next.Header)
+		self.next.Header.Del("Content-Length")
+		self.next.name = cacheName(self.next.URL, self.next.Vary)
+		f, err := ioutil.TempFile(self.cache.Dir, self.next.name+".*.tmp")
+		if err != nil {
+			L.Printf("CACHE Create: %s\n", err)
+		} else {
+			self.file = f
+		}
+	}
+	self.ResponseWriter.WriteHeader(code)
+}
+
+// whether the response to GET can be stored, RFC 7234 section 3
+func (self *cacheWriter) cacheable(code int, h http.Header) bool {
+	if self.r.Method != "GET" || code == http.StatusNotModified || code == http.StatusPartialContent {
+		return false
+	}
+	cc := parseCacheControl(h)
+	for _, k := range []string{"no-store", "private"} {
+		if _, ok := cc[k]; ok {
+			return false
+		}
+	}
+	_, public := cc["public"]
+	_, sMaxAge := cc["s-maxage"]
+	_, mustRevalidate := cc["must-revalidate"]
+	if self.r.Header.Get("Authorization") != "" && !public && !sMaxAge && !mustRevalidate {
+		return false
+	}
+	// trailers are not stored
+	if h.Get("Set-Cookie") != "" || h.Get("Trailer") != "" || strings.TrimSpace(h.Get("Vary")) == "*" {
+		return false
+	}
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n > self.cache.MaxObject {
+		return false
+	}
+
+	e := &cacheEntry{Status: code, Header: h, ResponseTime: time.Now()}
+	_, maxAge := cc["max-age"]
+	explicit := maxAge || sMaxAge || h.Get("Expires") != "" || public
+	if !explicit && !cacheableStatus[code] {
+		return false
+	}
+	return e.lifetime() > 0 || e.validatable()
+}
+
+func (self *cacheWriter) Write(b []byte) (int, error) {
+	if !self.wrote {
+		self.WriteHeader(http.StatusOK)
+	}
+	if self.notModified {
+		return len(b), nil
+	}
+	n, err := self.ResponseWriter.Write(b)
+	if self.file != nil {
+		self.next.Size += int64(n)
+		if self.next.Size > self.cache.MaxObject {
+			self.discard()
+		} else if _, err := self.file.Write(b[:n]); err != nil {
+			L.Printf("CACHE Write: %s\n", err)
+			self.discard()
+		}
+	}
+	return n, err
+}
+
+func (self *cacheWriter) Flush() {
+	if f, ok := self.ResponseWriter.(http.Flusher); ok && !self.notModified {
+		f.Flush()
+	}
+}
+
+func (self *cacheWriter) discard() {
+	self.file.Close()
+	os.Remove(self.file.Name())
+	self.file = nil
+}
+
+// store the response if the whole body is received
+func (self *cacheWriter) finish(err error) {
+	if self.file == nil {
+		return
+	}
+	if n, e := strconv.ParseInt(self.Header().Get("Content-Length"), 10, 64); err != nil || e == nil && n != self.next.Size {
+		self.discard()
+		return
+	}
+	if err = self.file.Close(); err != nil {
+		L.Printf("CACHE Close: %s\n", err)
+		os.Remove(self.file.Name())
+		return
+	}
+	if err = self.cache.store(self.next, self.file.Name()); err != nil {
+		L.Printf("CACHE Store: %s\n", err)
+		os.Remove(self.file.Name())
+		return
+	}
+	self.stored = true
+}
+
+// update the stored header by the 304 response, RFC 7234 section 4.3.4
+func (self *cacheWriter) revalidated() {
+	e := *self.entry
+	e.Header = self.entry.Header.Clone()
+	for k, vs := range self.next.Header {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection":
+			continue
+		}
+		e.Header[k] = vs
+	}
+	e.RequestTime, e.ResponseTime = self.start, time.Now()
+	self.entry = &e
+	if err := self.cache.store(&e, ""); err != nil {
+		L.Printf("CACHE Store: %s\n", err)
+	}
+}
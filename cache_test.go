@@ -0,0 +1,286 @@
+package mallory
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// origin server counting requests of each path
+type testOrigin struct {
+	*httptest.Server
+	hits  map[string]int
+	mutex sync.Mutex
+}
+
+func newTestOrigin(t *testing.T) *testOrigin {
+	self := &testOrigin{hits: make(map[string]int)}
+	self.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		self.mutex.Lock()
+		self.hits[r.URL.Path]++
+		self.mutex.Unlock()
+
+		h := w.Header()
+		switch r.URL.Path {
+		case "/fresh":
+			h.Set("Cache-Control", "max-age=60")
+			h.Set("ETag", `"v1"`)
+			fmt.Fprint(w, "fresh")
+		case "/stale":
+			// received long ago
+			h.Set("Date", time.Now().Add(-2*time.Minute).UTC().Format(http.TimeFormat))
+			h.Set("Cache-Control", "max-age=60")
+			fmt.Fprint(w, "stale")
+		case "/expires":
+			h.Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+			fmt.Fprint(w, "expires")
+		case "/vary":
+			h.Set("Cache-Control", "max-age=60")
+			h.Set("Vary", "Accept-Language")
+			fmt.Fprint(w, r.Header.Get("Accept-Language"))
+		case "/etag":
+			h.Set("Cache-Control", "no-cache")
+			h.Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				h.Set("X-Revalidated", "yes")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprint(w, "etag")
+		case "/no-store":
+			h.Set("Cache-Control", "no-store, max-age=60")
+			fmt.Fprint(w, "no-store")
+		case "/private":
+			h.Set("Cache-Control", "private, max-age=60")
+			fmt.Fprint(w, "private")
+		case "/cookie":
+			h.Set("Cache-Control", "max-age=60")
+			h.Set("Set-Cookie", "a=b")
+			fmt.Fprint(w, "cookie")
+		default:
+			// e.g. /big1, sized by the query
+			h.Set("Cache-Control", "max-age=60")
+			fmt.Fprint(w, strings.Repeat("x", len(r.URL.RawQuery)))
+		}
+	}))
+	t.Cleanup(self.Close)
+	return self
+}
+
+func (self *testOrigin) count(path string) int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.hits[path]
+}
+
+// fetch r from the origin as the direct fetcher does
+func testFetch(w http.ResponseWriter, r *http.Request) error {
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// request path through the cache with the header in "Key: value" pairs
+func (self *testOrigin) get(c *Cache, method, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, self.URL+path, nil)
+	for _, kv := range header {
+		i := strings.Index(kv, ":")
+		r.Header.Add(kv[:i], strings.TrimSpace(kv[i+1:]))
+	}
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r, testFetch)
+	return w
+}
+
+func openTestCache(t *testing.T, maxSize, maxObject int64) *Cache {
+	c, err := OpenCache(t.TempDir(), maxSize, maxObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCacheFreshness(t *testing.T) {
+	o := newTestOrigin(t)
+	c := openTestCache(t, 1<<20, 1<<20)
+
+	for _, path := range []string{"/fresh", "/expires"} {
+		for i := 0; i < 3; i++ {
+			w := o.get(c, "GET", path)
+			if w.Code != 200 || w.Body.String() != path[1:] {
+				t.Errorf("%s: %d %q", path, w.Code, w.Body)
+			}
+			if i > 0 && w.Header().Get("Age") == "" {
+				t.Errorf("%s: no Age of cached response", path)
+			}
+		}
+		if n := o.count(path); n != 1 {
+			t.Errorf("%s: origin hit %d times, want 1", path, n)
+		}
+	}
+
+	// stale without validator is fetched again
+	o.get(c, "GET", "/stale")
+	o.get(c, "GET", "/stale")
+	if n := o.count("/stale"); n != 2 {
+		t.Errorf("/stale: origin hit %d times, want 2", n)
+	}
+	// unless the client accepts stale
+	if w := o.get(c, "GET", "/stale", "Cache-Control: max-stale"); w.Body.String() != "stale" || o.count("/stale") != 2 {
+		t.Errorf("/stale: max-stale is not served from cache")
+	}
+
+	// the client asks for validation, or a younger response
+	o.get(c, "GET", "/fresh", "Cache-Control: no-cache")
+	o.get(c, "GET", "/fresh", "Pragma: no-cache")
+	if n := o.count("/fresh"); n != 3 {
+		t.Errorf("/fresh: origin hit %d times by no-cache, want 3", n)
+	}
+	if w := o.get(c, "GET", "/fresh", "Cache-Control: only-if-cached"); w.Code != 200 {
+		t.Errorf("/fresh: only-if-cached gets %d", w.Code)
+	}
+	if w := o.get(c, "GET", "/missing", "Cache-Control: only-if-cached"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("/missing: only-if-cached gets %d", w.Code)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	o := newTestOrigin(t)
+	c := openTestCache(t, 1<<20, 1<<20)
+
+	for _, lang := range []string{"en", "fr", "en", "fr"} {
+		w := o.get(c, "GET", "/vary", "Accept-Language: "+lang)
+		if w.Body.String() != lang {
+			t.Errorf("Accept-Language %s: got %q", lang, w.Body)
+		}
+	}
+	if n := o.count("/vary"); n != 2 {
+		t.Errorf("origin hit %d times, want 2", n)
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	o := newTestOrigin(t)
+	c := openTestCache(t, 1<<20, 1<<20)
+
+	o.get(c, "GET", "/etag")
+	w := o.get(c, "GET", "/etag")
+	if w.Code != 200 || w.Body.String() != "etag" {
+		t.Errorf("revalidated: %d %q", w.Code, w.Body)
+	}
+	// the header of 304 is stored
+	if w.Header().Get("X-Revalidated") != "yes" {
+		t.Errorf("header of 304 is not merged: %v", w.Header())
+	}
+	if n := o.count("/etag"); n != 2 {
+		t.Errorf("origin hit %d times, want 2", n)
+	}
+
+	// conditional request of the client is answered by cache
+	o.get(c, "GET", "/fresh")
+	if w := o.get(c, "GET", "/fresh", `If-None-Match: "v1"`); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match: %d %q", w.Code, w.Body)
+	}
+	if w := o.get(c, "GET", "/fresh", `If-None-Match: "v2"`); w.Code != 200 {
+		t.Errorf("If-None-Match of another ETag: %d", w.Code)
+	}
+	if n := o.count("/fresh"); n != 1 {
+		t.Errorf("/fresh: origin hit %d times, want 1", n)
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	o := newTestOrigin(t)
+	c := openTestCache(t, 1<<20, 1<<20)
+
+	for _, path := range []string{"/no-store", "/private", "/cookie"} {
+		for i := 0; i < 2; i++ {
+			if w := o.get(c, "GET", path); w.Body.String() != path[1:] {
+				t.Errorf("%s: got %q", path, w.Body)
+			}
+		}
+		if n := o.count(path); n != 2 {
+			t.Errorf("%s: origin hit %d times, want 2", path, n)
+		}
+	}
+
+	// no-store of request, and Authorization
+	o.get(c, "GET", "/big?ab", "Cache-Control: no-store")
+	o.get(c, "GET", "/big?ab", "Authorization: Basic eDp5")
+	o.get(c, "GET", "/big?ab")
+	if n := o.count("/big"); n != 3 {
+		t.Errorf("/big: origin hit %d times, want 3", n)
+	}
+}
+
+func TestCacheHEAD(t *testing.T) {
+	o := newTestOrigin(t)
+	c := openTestCache(t, 1<<20, 1<<20)
+
+	// HEAD is never stored
+	o.get(c, "HEAD", "/fresh")
+	if w := o.get(c, "GET", "/fresh"); w.Body.String() != "fresh" {
+		t.Errorf("GET after HEAD: %q", w.Body)
+	}
+	if n := o.count("/fresh"); n != 2 {
+		t.Errorf("origin hit %d times, want 2", n)
+	}
+
+	// but served from the stored GET
+	w := o.get(c, "HEAD", "/fresh")
+	if w.Code != 200 || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "5" {
+		t.Errorf("HEAD: %d %q %v", w.Code, w.Body, w.Header())
+	}
+	if n := o.count("/fresh"); n != 2 {
+		t.Errorf("origin hit %d times by HEAD, want 2", n)
+	}
+
+	// unsafe methods invalidate
+	o.get(c, "POST", "/fresh")
+	o.get(c, "GET", "/fresh")
+	if n := o.count("/fresh"); n != 4 {
+		t.Errorf("origin hit %d times after POST, want 4", n)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	o := newTestOrigin(t)
+	c := openTestCache(t, 10, 8)
+
+	o.get(c, "GET", "/big1?123456")
+	o.get(c, "GET", "/big2?123456")
+	// the least recently used is evicted
+	o.get(c, "GET", "/big2?123456")
+	o.get(c, "GET", "/big1?123456")
+	if n1, n2 := o.count("/big1"), o.count("/big2"); n1 != 2 || n2 != 1 {
+		t.Errorf("origin hit %d and %d times, want 2 and 1", n1, n2)
+	}
+
+	// larger than max object
+	o.get(c, "GET", "/big3?123456789")
+	o.get(c, "GET", "/big3?123456789")
+	if n := o.count("/big3"); n != 2 {
+		t.Errorf("/big3: origin hit %d times, want 2", n)
+	}
+	c.mutex.Lock()
+	size := c.size
+	c.mutex.Unlock()
+	if size > c.MaxSize {
+		t.Errorf("size %d over %d", size, c.MaxSize)
+	}
+}
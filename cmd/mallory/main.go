@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/publicsuffix"
 
@@ -16,6 +25,10 @@ var (
 	FConfig = flag.String("config", "$HOME/.config/mallory.json", "config file")
 	FSuffix = flag.String("suffix", "", "print pulbic suffix for the given domain")
 	FReload = flag.Bool("reload", false, "send signal to reload config file")
+	FStats  = flag.Bool("stats", false, "print route stats of hosts")
+	FHost   = flag.String("host", "", "print route stats of the given host only")
+	FUsage  = flag.Bool("usage", false, "print bytes of clients today and this month")
+	FClient = flag.String("client", "", "print usage of the given client only")
 )
 
 func serve() {
@@ -29,27 +42,113 @@ func serve() {
 
 	L.Printf("Connecting remote SSH server: %s\n", c.File.RemoteServer)
 
-	wait := make(chan int)
-	go func() {
-		normal, err := NewServer(NormalSrv, c)
+	// limits, bandwidth and usage are shared by both servers
+	limiter, shaper, usage := NewLimiter(c), NewShaper(c), NewUsage()
+	if c.File.UsageFile != "" {
+		if err = usage.Open(os.ExpandEnv(c.File.UsageFile)); err != nil {
+			L.Fatalln(err)
+		}
+	}
+	normal, err := NewServer(NormalSrv, c, limiter, shaper, usage)
+	if err != nil {
+		L.Fatalln(err)
+	}
+	smart, err := NewServer(SmartSrv, c, limiter, shaper, usage)
+	if err != nil {
+		L.Fatalln(err)
+	}
+
+	// listen all before ready, sockets may be inherited from the old process
+	normalLn, err := Listen("tcp", c.File.LocalNormalServer)
+	if err != nil {
+		L.Fatalln(err)
+	}
+	smartLn, err := Listen("tcp", c.File.LocalSmartServer)
+	if err != nil {
+		L.Fatalln(err)
+	}
+	if c.File.LocalDNSServer != "" {
+		pc, err := ListenPacket("udp", c.File.LocalDNSServer)
+		if err != nil {
+			L.Fatalln(err)
+		}
+		ln, err := Listen("tcp", c.File.LocalDNSServer)
 		if err != nil {
 			L.Fatalln(err)
 		}
+		go func() {
+			L.Printf("Local DNS server: %s\n", c.File.LocalDNSServer)
+			L.Fatalln(NewDNS(smart).Serve(pc, ln))
+		}()
+	}
+
+	errc := make(chan error, 2)
+	go func() {
 		L.Printf("Local normal HTTP proxy: %s\n", c.File.LocalNormalServer)
-		L.Fatalln(http.ListenAndServe(c.File.LocalNormalServer, normal))
-		wait <- 1
+		errc <- normal.Serve(normalLn)
 	}()
+	go func() {
+		L.Printf("Local smart HTTP proxy: %s\n", c.File.LocalSmartServer)
+		errc <- smart.Serve(smartLn)
+	}()
+	Ready()
 
+	status := 0
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGTERM, os.Interrupt, syscall.SIGUSR2)
+wait:
+	for {
+		select {
+		case err := <-errc:
+			L.Println(err)
+			status = 1
+			break wait
+		case s := <-sc:
+			if s != syscall.SIGUSR2 {
+				L.Printf("Received %s, shutting down...\n", s)
+				break wait
+			}
+			L.Printf("Received %s, upgrading...\n", s)
+			if err := Upgrade(); err != nil {
+				L.Printf("Upgrade: %s\n", err)
+				continue
+			}
+			L.Printf("New process is ready, shutting down...\n")
+			break wait
+		}
+	}
 	go func() {
-		smart, err := NewServer(SmartSrv, c)
-		if err != nil {
-			L.Fatalln(err)
+		for s := range sc {
+			if s != syscall.SIGUSR2 {
+				L.Fatalf("Received %s again, exit now\n", s)
+			}
 		}
-		L.Printf("Local smart HTTP proxy: %s\n", c.File.LocalSmartServer)
-		L.Fatalln(http.ListenAndServe(c.File.LocalSmartServer, smart))
-		wait <- 1
 	}()
-	<-wait
+
+	timeout := time.Duration(c.File.ShutdownTimeoutS) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	// both servers are drained with the same deadline
+	var wg sync.WaitGroup
+	var failed int32
+	for _, srv := range []*Server{normal, smart} {
+		wg.Add(1)
+		go func(srv *Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				L.Printf("Shutdown: %s\n", err)
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	cancel()
+
+	if failed != 0 {
+		status = 1
+	}
+	L.Printf("Exit with status %d\n", status)
+	os.Exit(status)
 }
 
 func printSuffix() {
@@ -60,12 +159,24 @@ func printSuffix() {
 	fmt.Printf("PublicSuffix: %s\n", suffix)
 }
 
+// get the path from local server at addr, through HTTPS if served with certificate
+func get(file *ConfigFile, addr, path string) (*http.Response, error) {
+	if file.LocalCert == "" {
+		return http.Get(fmt.Sprintf("http://%s%s", addr, path))
+	}
+	// the certificate may not be issued for the local addr
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	return client.Get(fmt.Sprintf("https://%s%s", addr, path))
+}
+
 func reload() {
 	file, err := NewConfigFile(os.ExpandEnv(*FConfig))
 	if err != nil {
 		L.Fatal(err)
 	}
-	res, err := http.Get(fmt.Sprintf("http://%s/reload", file.LocalNormalServer))
+	res, err := get(file, file.LocalNormalServer, "/reload")
 	if err != nil {
 		L.Fatal(err)
 	}
@@ -77,6 +188,32 @@ func reload() {
 	fmt.Printf("%s\n", body)
 }
 
+func stats() {
+	file, err := NewConfigFile(os.ExpandEnv(*FConfig))
+	if err != nil {
+		L.Fatal(err)
+	}
+	res, err := get(file, file.LocalSmartServer, "/stats?host="+url.QueryEscape(*FHost))
+	if err != nil {
+		L.Fatal(err)
+	}
+	defer res.Body.Close()
+	io.Copy(os.Stdout, res.Body)
+}
+
+func usage() {
+	file, err := NewConfigFile(os.ExpandEnv(*FConfig))
+	if err != nil {
+		L.Fatal(err)
+	}
+	res, err := get(file, file.LocalSmartServer, "/usage?client="+url.QueryEscape(*FClient))
+	if err != nil {
+		L.Fatal(err)
+	}
+	defer res.Body.Close()
+	io.Copy(os.Stdout, res.Body)
+}
+
 func main() {
 	flag.Parse()
 
@@ -84,6 +221,10 @@ func main() {
 		printSuffix()
 	} else if *FReload {
 		reload()
+	} else if *FStats {
+		stats()
+	} else if *FUsage {
+		usage()
 	} else {
 		serve()
 	}
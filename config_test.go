@@ -0,0 +1,178 @@
+package mallory
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigUser(t *testing.T) {
+	c := &Config{File: &ConfigFile{Users: map[string]string{"alice": "secret"}}}
+	for _, tt := range []struct {
+		user, passwd string
+		ok           bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+		{"", "", false},
+	} {
+		r := proxyAuthRequest("http://example.com/", tt.user, tt.passwd)
+		if user, ok := c.User(r); ok != tt.ok || ok && user != tt.user {
+			t.Errorf("%s:%s: user %q, %v", tt.user, tt.passwd, user, ok)
+		}
+		// keyed by IP without the verified user
+		if client := ClientOf(r); client != "192.0.2.1" {
+			t.Errorf("%s:%s: client %q, want the IP", tt.user, tt.passwd, client)
+		}
+	}
+}
+
+func TestConfigTimeouts(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		want Timeouts
+	}{
+		// only the handshake by default
+		{`{}`, Timeouts{Handshake: 10 * time.Second}},
+		{`{"handshake_timeout_s": -1, "header_timeout_s": 5, "idle_timeout_s": 60, "lifetime_s": 3600}`,
+			Timeouts{Header: 5 * time.Second, Idle: time.Minute, Lifetime: time.Hour}},
+		{`{"header_timeout_s": -1, "idle_timeout_s": -1}`, Timeouts{Handshake: 10 * time.Second}},
+	} {
+		path := filepath.Join(t.TempDir(), "mallory.json")
+		if err := os.WriteFile(path, []byte(tt.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := NewConfigFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := file.Timeouts(); got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.conf, got, tt.want)
+		}
+	}
+}
+
+func TestConfigRoute(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mallory.json")
+	os.WriteFile(path, []byte(`{"routes": {
+		"www.example.com": "direct",
+		"example.com": "corp",
+		"co.uk": "proxy",
+		"intranet.corp": "direct",
+		"*.corp": "a",
+		"*.eu.corp": "b",
+		"db?.eu.corp": "c",
+		"10.0.0.0/8": "direct",
+		"10.1.0.0/16": "corp",
+		"geoip:CN": "direct"
+	}}`), 0644)
+	file, err := NewConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		host, name string
+	}{
+		// the host itself before its TLD+1
+		{"www.example.com", "direct"},
+		{"api.example.com", "corp"},
+		{"example.com", "corp"},
+		// public suffix
+		{"news.bbc.co.uk", "proxy"},
+		// the host itself before wildcards
+		{"intranet.corp", "direct"},
+		// the longest wildcard wins
+		{"git.corp", "a"},
+		{"git.eu.corp", "b"},
+		{"db1.eu.corp", "c"},
+		{"db10.eu.corp", "b"},
+		// IPs are routed by RouteIP only
+		{"10.1.2.3", ""},
+		{"github.com", ""},
+	} {
+		if name, ok := file.Route(tt.host); name != tt.name || ok != (tt.name != "") {
+			t.Errorf("%s: routed to %q, %v, want %q", tt.host, name, ok, tt.name)
+		}
+	}
+
+	for ip, want := range map[string]string{"10.1.2.3": "corp", "10.2.3.4": "direct", "192.0.2.1": ""} {
+		if name, ok := file.RouteIP(net.ParseIP(ip)); name != want || ok != (want != "") {
+			t.Errorf("%s: routed to %q, %v, want %q", ip, name, ok, want)
+		}
+	}
+}
+
+func TestServerRouteOutbound(t *testing.T) {
+	srv := newTestServer(t, `"remotes": {"corp": "http://127.0.0.1:2"},
+		"routes": {"direct.example": "direct", "proxy.example": "proxy", "corp.example": "corp", "lost.example": "lost"}`)
+	for host, want := range map[string]struct {
+		name   string
+		remote Remote
+	}{
+		"direct.example": {"DIRECT", nil},
+		"proxy.example":  {"PROXY", srv.Remote},
+		"corp.example":   {"corp", srv.Remotes["corp"]},
+		// unknown remotes fall back to the default one
+		"lost.example": {"PROXY", srv.Remote},
+	} {
+		name, remote, reason := srv.route(host, false, true)
+		if name != want.name || remote != want.remote || reason != "routes" {
+			t.Errorf("%s: routed to %s %v by %s, want %s", host, name, remote, reason, want.name)
+		}
+	}
+}
+
+func TestServerRouteIPCache(t *testing.T) {
+	srv := newTestServer(t, `"remotes": {"corp": "http://127.0.0.1:2"}, "routes": {"127.0.0.0/8": "corp"}`)
+	if name, _, reason := srv.route("localhost", true, true); name != "corp" || reason != "IP routes" {
+		t.Errorf("localhost: routed to %s by %s", name, reason)
+	}
+	// cached, or never resolved
+	if name, _, _ := srv.route("localhost", false, true); name != "corp" {
+		t.Errorf("localhost: cached route %s", name)
+	}
+	srv.IPRoutes.Set("cached.invalid", ipRouteEntry{name: "corp", ok: true})
+	if name, _, _ := srv.route("cached.invalid", true, true); name != "corp" {
+		t.Errorf("cached.invalid: routed to %s, not by cache", name)
+	}
+
+	// dropped once reloaded
+	if err := srv.Cfg.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name, _, _ := srv.route("cached.invalid", false, true); name != "DIRECT" {
+		t.Errorf("cached.invalid: routed to %s after reloaded", name)
+	}
+	if srv.IPRoutes.Len() != 0 {
+		t.Errorf("%d IP routes after reloaded", srv.IPRoutes.Len())
+	}
+}
+
+func TestServerExplain(t *testing.T) {
+	srv := newTestServer(t, `"remotes": {"corp": "http://127.0.0.1:2"}, "routes": {"127.0.0.0/8": "corp"}`)
+	// never resolved
+	if name, reason := srv.Explain("localhost"); name != "DIRECT" || reason != defaultReason {
+		t.Errorf("localhost: explained as %s by %s", name, reason)
+	}
+	if srv.IPRoutes.Len() != 0 {
+		t.Errorf("localhost is resolved by Explain")
+	}
+	srv.IPRoutes.Set("localhost", ipRouteEntry{name: "corp", ok: true})
+	if name, reason := srv.Explain("localhost"); name != "corp" || reason != "IP routes" {
+		t.Errorf("localhost: explained as %s by %s, not by cache", name, reason)
+	}
+
+	// never races to explore
+	for i := 0; i < statsMinSamples; i++ {
+		srv.Stats.Failed("slow.example", false)
+	}
+	for i := 0; i < 10*statsExplore; i++ {
+		if name, _ := srv.Explain("slow.example"); name != "PROXY" {
+			t.Fatalf("slow.example: explained as %s", name)
+		}
+	}
+}
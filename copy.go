@@ -0,0 +1,99 @@
+package mallory
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// buffer size to copy connections which can not be spliced
+	copyBufferSize = 32 * 1024
+	// bytes spliced at most between checks of timeouts and bandwidth
+	spliceChunk = 1 << 20
+)
+
+// buffers shared by all copies, e.g. SSH channels and HTTP responses
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// hide ReadFrom and WriteTo, which allocate their own buffers
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
+
+// copy src to dst through a pooled buffer
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buf)
+}
+
+// underlying TCP connection of c to splice data directly, nil if not
+func tcpConnOf(c interface{}) *net.TCPConn {
+	switch c := c.(type) {
+	case *net.TCPConn:
+		return c
+	case *bufConn:
+		// data buffered must be read first
+		if c.r.Buffered() == 0 {
+			return tcpConnOf(c.Conn)
+		}
+	}
+	return nil
+}
+
+// copy src to dst, spliced in the kernel without copying to user space if
+// both are TCP connections, or through a pooled buffer otherwise. Bytes are
+// counted by m as they are copied.
+func copyConn(dst io.Writer, src io.Reader, wd *watchdog, sh *Shaping, m *Meter) (int64, error) {
+	if d, s := tcpConnOf(dst), tcpConnOf(src); d != nil && s != nil {
+		return spliceTCP(d, s, wd, sh, m)
+	}
+	return copyBuffer(dst, m.Reader(sh.Reader(wd.Reader(src))))
+}
+
+// Splice src to dst in chunks by TCPConn.ReadFrom, which uses splice(2) for
+// a limited reader of TCPConn. The watchdog is marked active, bandwidth is
+// taken and bytes are counted after each chunk. A chunk is ended by the read deadline at half of the
+// idle timeout, so a slow connection is still marked active in time.
+func spliceTCP(dst, src *net.TCPConn, wd *watchdog, sh *Shaping, m *Meter) (written int64, err error) {
+	chunk := int64(spliceChunk)
+	if sh != nil {
+		chunk = int64(sh.Chunk)
+	}
+	for {
+		if wd.idle > 0 {
+			src.SetReadDeadline(time.Now().Add(wd.idle / 2))
+		}
+		n, err := dst.ReadFrom(&io.LimitedReader{R: src, N: chunk})
+		written += n
+		if n > 0 {
+			wd.Active()
+			m.Add(n)
+			sh.Wait(int(n))
+		}
+		if err != nil {
+			// closed by the watchdog once idle for long
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			return written, err
+		}
+		if n < chunk {
+			// EOF
+			return written, nil
+		}
+	}
+}
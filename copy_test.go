@@ -0,0 +1,101 @@
+package mallory
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// bytes through each tunnel
+const benchTunnelSize = 4 << 20
+
+// connected pair of TCP connections of the listener
+func tcpPairOf(ln net.Listener) (net.Conn, net.Conn, error) {
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, s, nil
+}
+
+// relay a tunnel from client to server by cp, as the proxy does
+func relay(ln net.Listener, buf []byte, cp func(dst, src net.Conn) (int64, error)) (int64, error) {
+	client, src, err := tcpPairOf(ln)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	defer src.Close()
+	dst, server, err := tcpPairOf(ln)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	defer server.Close()
+
+	go func() {
+		for n := 0; n < benchTunnelSize; n += len(buf) {
+			if _, err := client.Write(buf); err != nil {
+				break
+			}
+		}
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, server)
+		close(done)
+	}()
+	n, err := cp(dst, src)
+	dst.(*net.TCPConn).CloseWrite()
+	<-done
+	return n, err
+}
+
+// concurrent tunnels relayed by cp
+func benchmarkRelay(b *testing.B, cp func(dst, src net.Conn) (int64, error)) {
+	b.ReportAllocs()
+	b.SetBytes(benchTunnelSize)
+	b.RunParallel(func(pb *testing.PB) {
+		// accepted connections are paired with the ones dialed by the same goroutine
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer ln.Close()
+		buf := make([]byte, copyBufferSize)
+		for pb.Next() {
+			n, err := relay(ln, buf, cp)
+			if err != nil || n != benchTunnelSize {
+				b.Errorf("relayed %d bytes: %v", n, err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkSpliceTCP(b *testing.B) {
+	benchmarkRelay(b, func(dst, src net.Conn) (int64, error) {
+		wd := newWatchdog(0, 0, func(string) {})
+		return spliceTCP(dst.(*net.TCPConn), src.(*net.TCPConn), wd, nil, nil)
+	})
+}
+
+func BenchmarkCopyBuffer(b *testing.B) {
+	benchmarkRelay(b, func(dst, src net.Conn) (int64, error) {
+		return copyBuffer(dst, src)
+	})
+}
+
+// io.Copy with a new buffer each time, ReadFrom is hidden or it splices too
+func BenchmarkIOCopy(b *testing.B) {
+	benchmarkRelay(b, func(dst, src net.Conn) (int64, error) {
+		return io.Copy(writerOnly{dst}, readerOnly{src})
+	})
+}
@@ -0,0 +1,218 @@
+package mallory
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	ErrBogusDNS = errors.New("bogus DNS answer")
+
+	// IPs never answered by a sane DNS
+	bogusNets = []string{
+		"0.0.0.0/8",
+		"240.0.0.0/4",
+		"::/128",
+	}
+)
+
+const (
+	// wait for the client to speak first in CONNECT
+	detectClientWait = 500 * time.Millisecond
+	// wait for the first response of server after the client spoke
+	detectServerWait = 5 * time.Second
+	// max TLS record of plaintext, with the header
+	tlsMaxRecord = 5 + 16384
+)
+
+// Detector of interference on direct connections, such as resets,
+// broken TLS handshakes and poisoned DNS answers
+type Detector struct {
+	// global config file
+	Cfg *Config
+	// called when host is detected as interfered
+	OnBlocked func(host string, reason error)
+}
+
+// whether err of dial or handshake looks like caused by interference, i.e.
+// resets and bogus DNS. Timeouts and EOFs are not, a slow or closing server
+// looks the same once a request was sent
+func (self *Detector) Interfered(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, ErrBogusDNS) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+// whether err of reading the response of TLS client hello looks like caused
+// by interference, any server answers the hello in time
+func (self *Detector) unanswered(err error) bool {
+	if self.Interfered(err) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// report host is interfered
+func (self *Detector) Block(host string, reason error) {
+	if self.OnBlocked != nil {
+		self.OnBlocked(HostOnly(host), reason)
+	}
+}
+
+// whether ip is a known bogus answer of DNS
+func (self *Detector) Bogus(ip net.IP) bool {
+	return self.Cfg.Bogus(ip)
+}
+
+// Resolve host, error is ErrBogusDNS if any answer is bogus
+func (self *Detector) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if self.Bogus(addr.IP) {
+			return nil, ErrBogusDNS
+		}
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// whether any address in the raw DNS response is bogus
+func (self *Detector) BogusAnswer(resp []byte) bool {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return false
+	}
+	for _, rr := range m.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			if self.Bogus(net.IP(body.A[:])) {
+				return true
+			}
+		case *dnsmessage.AAAAResource:
+			if self.Bogus(net.IP(body.AAAA[:])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Resolve the host of addr and dial the IPs in order, the bogus answers
+// are reported as blocked
+func (self *Detector) Dial(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network, addr string) (c net.Conn, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	ips, err := self.Resolve(ctx, host)
+	if err != nil {
+		if err == ErrBogusDNS {
+			self.Block(host, err)
+		}
+		return
+	}
+	for _, ip := range ips {
+		c, err = dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Make sure the server responds to the TLS client hello in CONNECT, or replay
+// the hello through fallback. Nothing has been sent to the client yet, so it's
+// safe to switch the route. Returns the connection to use and the data should
+// be sent to client first.
+func (self *Detector) Handshake(src, dst net.Conn, addr string, fallback func(network, addr string) (net.Conn, error)) (net.Conn, []byte, error) {
+	hello := make([]byte, 32*1024)
+	src.SetReadDeadline(time.Now().Add(detectClientWait))
+	n, err := src.Read(hello)
+	src.SetReadDeadline(time.Time{})
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			// the server speaks first
+			return dst, nil, nil
+		}
+		return dst, nil, err
+	}
+	hello = hello[:n]
+
+	// a hello larger than a segment, e.g. with post-quantum key shares, may be
+	// read in parts, and the server never answers a partial record
+	if hello[0] == 0x16 {
+		src.SetReadDeadline(time.Now().Add(detectServerWait))
+		hello, err = readRecord(src, hello)
+		src.SetReadDeadline(time.Time{})
+		if err != nil {
+			return dst, nil, err
+		}
+	}
+
+	if _, err = dst.Write(hello); err != nil {
+		return dst, nil, err
+	}
+	// not TLS, or connected through remote which does not support deadline
+	if hello[0] != 0x16 || dst.SetReadDeadline(time.Now().Add(detectServerWait)) != nil {
+		return dst, nil, nil
+	}
+	resp := make([]byte, 32*1024)
+	n, err = dst.Read(resp)
+	dst.SetReadDeadline(time.Time{})
+	if err == nil {
+		return dst, resp[:n], nil
+	}
+	if !self.unanswered(err) {
+		return dst, nil, err
+	}
+
+	L.Printf("Handshake %s: %s, reproxy...\n", addr, err)
+	self.Block(addr, err)
+	c, err := fallback("tcp", addr)
+	if err != nil {
+		return dst, nil, err
+	}
+	dst.Close()
+	if _, err = c.Write(hello); err != nil {
+		return c, nil, err
+	}
+	return c, nil, nil
+}
+
+// read the rest of the TLS record started in b, b is returned as is if the
+// record is larger than the max
+func readRecord(r io.Reader, b []byte) ([]byte, error) {
+	if len(b) < 5 {
+		head := make([]byte, 5)
+		copy(head, b)
+		if _, err := io.ReadFull(r, head[len(b):]); err != nil {
+			return b, err
+		}
+		b = head
+	}
+	n := 5 + int(binary.BigEndian.Uint16(b[3:5]))
+	if n > tlsMaxRecord || len(b) >= n {
+		return b, nil
+	}
+	record := make([]byte, n)
+	copy(record, b)
+	_, err := io.ReadFull(r, record[len(b):])
+	return record, err
+}
@@ -0,0 +1,184 @@
+package mallory
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// connection to write the first data in two parts, as TCP segments
+type splitConn struct {
+	net.Conn
+	at    int
+	delay time.Duration
+	done  bool
+}
+
+func (self *splitConn) Write(b []byte) (int, error) {
+	if self.done || len(b) <= self.at {
+		return self.Conn.Write(b)
+	}
+	self.done = true
+	n, err := self.Conn.Write(b[:self.at])
+	if err != nil {
+		return n, err
+	}
+	time.Sleep(self.delay)
+	m, err := self.Conn.Write(b[self.at:])
+	return n + m, err
+}
+
+// connected pair of TCP connections
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+func TestHandshakeSplitHello(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	// handshakes are never finished by the tests
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	// in the header, and in the body of the record
+	for _, at := range []int{3, 100} {
+		client, src := tcpPair(t)
+		dst, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go tls.Client(&splitConn{Conn: client, at: at, delay: 200 * time.Millisecond},
+			&tls.Config{InsecureSkipVerify: true}).Handshake()
+
+		var blocked error
+		d := &Detector{Cfg: &Config{File: &ConfigFile{}}, OnBlocked: func(host string, reason error) {
+			blocked = reason
+		}}
+		fallback := func(network, addr string) (net.Conn, error) {
+			t.Errorf("split at %d: fallback is dialed", at)
+			return net.Dial(network, addr)
+		}
+		c, first, err := d.Handshake(src, dst, addr, fallback)
+		if err != nil {
+			t.Errorf("split at %d: %s", at, err)
+		}
+		if blocked != nil {
+			t.Errorf("split at %d: blocked by %s", at, blocked)
+		}
+		if c != dst || len(first) == 0 || first[0] != 0x16 {
+			t.Errorf("split at %d: no server hello, got %d bytes", at, len(first))
+		}
+		c.Close()
+		client.Close()
+		src.Close()
+	}
+}
+
+func TestReadRecord(t *testing.T) {
+	client, src := tcpPair(t)
+	defer client.Close()
+	defer src.Close()
+
+	// larger than the max record, returned as is
+	b, err := readRecord(src, []byte{0x16, 3, 1, 0xff, 0xff, 1})
+	if err != nil || len(b) != 6 {
+		t.Errorf("large record: %d bytes, %v", len(b), err)
+	}
+
+	// the rest is read
+	go client.Write([]byte{0, 4, 1, 2, 3, 4})
+	b, err = readRecord(src, []byte{0x16, 3, 1})
+	if err != nil || string(b) != "\x16\x03\x01\x00\x04\x01\x02\x03\x04" {
+		t.Errorf("split record: %q, %v", b, err)
+	}
+
+	// truncated
+	client.Write([]byte{1})
+	client.Close()
+	if _, err = readRecord(src, []byte{0x16, 3, 1, 0, 4}); err == nil {
+		t.Errorf("truncated record is read")
+	}
+}
+
+func TestInterfered(t *testing.T) {
+	d := &Detector{Cfg: &Config{File: &ConfigFile{}}}
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{ErrBogusDNS, true},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNRESET)}, true},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNABORTED)}, true},
+		{io.EOF, false},
+		{io.ErrUnexpectedEOF, false},
+		{os.ErrDeadlineExceeded, false},
+		{errors.New("net/http: timeout awaiting response headers"), false},
+	} {
+		if got := d.Interfered(c.err); got != c.want {
+			t.Errorf("Interfered(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+	// the server never answering the hello is
+	for _, err := range []error{io.EOF, os.ErrDeadlineExceeded} {
+		if !d.unanswered(err) {
+			t.Errorf("unanswered(%v) = false", err)
+		}
+	}
+}
+
+func TestDirectClosedAfterRequest(t *testing.T) {
+	// the server closes once the request is read
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			http.ReadRequest(bufio.NewReader(c))
+			c.Close()
+		}
+	}()
+	srv := newTestServer(t, "")
+	srv.Remote = &testRemote{}
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	r := httptest.NewRequest("GET", "http://localhost:"+port+"/", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want replayed through the remote", w.Code)
+	}
+	if srv.Blocked("localhost") {
+		t.Errorf("host is blocked by EOF after the request was sent")
+	}
+}
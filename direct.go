@@ -1,10 +1,14 @@
 package mallory
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,18 +23,73 @@ type closeWriter interface {
 // Direct fetcher
 type Direct struct {
 	Tr *http.Transport
+	// detect interference, nil to disable
+	Detector *Detector
+	// dial the fallback route for the request of ctx when direct connection
+	// failed, nil to disable
+	Fallback func(ctx context.Context, network, addr string) (net.Conn, error)
+	// called with bytes received from host through conn in d, nil to disable
+	Transferred func(host string, conn net.Conn, n int64, d time.Duration)
+	// timeouts of requests and tunnels
+	Timeouts Timeouts
+	// bandwidth limits, nil to disable
+	Shaper *Shaper
+	// bytes of clients, nil to disable
+	Usage *Usage
 }
 
-// Create and initialize
-func NewDirect(shouldProxyTimeout time.Duration) *Direct {
+// Create and initialize, connect hosts through the upstream proxy if not empty
+func NewDirect(shouldProxyTimeout time.Duration, upstream string) (*Direct, error) {
 	if shouldProxyTimeout == 0 {
 		shouldProxyTimeout = 200 * time.Millisecond
 	}
-	tr := http.DefaultTransport.(*http.Transport)
-	tr.Dial = (&net.Dialer{
+	dialer, err := NewDialer(upstream, &net.Dialer{
 		Timeout: shouldProxyTimeout,
-	}).Dial
-	return &Direct{Tr: tr}
+	})
+	if err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	// Accept-Encoding of client is sent as is, never decompress for it
+	tr.DisableCompression = true
+	tr.Dial = dialer.Dial
+	tr.DialContext = dialer.DialContext
+	if upstream != "" {
+		// all hosts are reached by the upstream proxy dialer
+		tr.Proxy = nil
+	}
+	return &Direct{Tr: tr}, nil
+}
+
+// Set timeouts of requests and tunnels, and the transport
+func (self *Direct) SetTimeouts(t Timeouts) {
+	self.Timeouts = t
+	self.Tr.TLSHandshakeTimeout = t.Handshake
+	self.Tr.ResponseHeaderTimeout = t.Header
+}
+
+// bandwidth limits of the request through outbound, nil if unlimited
+func (self *Direct) shaping(r *http.Request, outbound string) *Shaping {
+	if self.Shaper == nil {
+		return nil
+	}
+	return self.Shaper.Shaping(ClientOf(r), outbound, r.URL.Host)
+}
+
+// meter of bytes of the request through outbound, sent to host or received
+func (self *Direct) meter(r *http.Request, outbound string, sent bool) *Meter {
+	if self.Usage == nil {
+		return nil
+	}
+	return self.Usage.Meter(ClientOf(r), outbound, sent)
+}
+
+// dial addr with the dialer of transport
+func (self *Direct) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if self.Tr.DialContext != nil {
+		return self.Tr.DialContext(ctx, network, addr)
+	}
+	return self.Tr.Dial(network, addr)
 }
 
 // Data flow:
@@ -46,33 +105,90 @@ func (self *Direct) ServeHTTP(w http.ResponseWriter, r *http.Request) (err error
 	}
 	start := time.Now()
 
+	// the request is aborted once timed out
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timeout := func(reason string) {
+		L.Printf("TIMEOUT %s: %s\n", r.URL.Host, reason)
+		cancel()
+	}
+	lifetime := newWatchdog(0, self.Timeouts.Lifetime, timeout)
+	defer lifetime.Stop()
+
+	// the request may be replayed through fallback if it has not been sent
+	var wrote int32
+	var conn net.Conn
+	// the body is sent after connected, through the outbound known by then
+	var sent *Meter
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = info.Conn
+			sent = self.meter(r, outboundOf(RouteOf(r), Proxied(conn)), true)
+		},
+		WroteHeaders: func() { atomic.StoreInt32(&wrote, 1) },
+	}
+	req := r.WithContext(httptrace.WithClientTrace(ctx, trace))
+	if r.Body != nil && r.Body != http.NoBody {
+		req.Body = &meteredBody{ReadCloser: r.Body, add: func(n int64) { sent.Add(n) }}
+	}
+
 	// Client.Do is different from DefaultTransport.RoundTrip ...
 	// Client.Do will change some part of request as a new request of the server.
 	// The underlying RoundTrip never changes anything of the request.
-	resp, err := self.Tr.RoundTrip(r)
+	resp, err := self.Tr.RoundTrip(req)
 	if err != nil {
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		// nothing has been sent to client, safe to retry if the request can be
+		// sent again and has no side effect
+		replayable := r.Body == http.NoBody || r.GetBody != nil
+		unsent := atomic.LoadInt32(&wrote) == 0
+		safe := unsent || Idempotent(r.Method)
+		if self.Fallback != nil && Raced(r.Context()) && replayable && safe {
 			L.Printf("RoundTrip: %s, reproxy...\n", err.Error())
+			// only failures before the request was sent are interference, the
+			// server may be just slow to respond
+			if self.Detector != nil && unsent && self.Detector.Interfered(err) {
+				self.Detector.Block(r.URL.Host, err)
+			}
 			err = ErrShouldProxy
 			return
 		}
 		L.Printf("RoundTrip: %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		Fail(w, r, err)
 		return
 	}
 	defer resp.Body.Close()
+	outbound := outboundOf(RouteOf(r), conn != nil && Proxied(conn))
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return self.upgrade(w, r, resp, start, outbound)
+	}
 
 	// please prepare header first and write them
 	CopyHeader(w, resp)
+	RemoveHopHeaders(w.Header())
+	AnnounceTrailer(w, resp)
+	w.Header().Add("Via", Via(resp.ProtoMajor, resp.ProtoMinor))
 	w.WriteHeader(resp.StatusCode)
 
-	n, err := io.Copy(w, resp.Body)
+	idle := newWatchdog(self.Timeouts.Idle, 0, timeout)
+	fw := NewFlushWriter(w, resp)
+	body := self.meter(r, outbound, false).Reader(idle.Reader(resp.Body))
+	n, err := copyBuffer(fw, self.shaping(r, outbound).Reader(body))
+	fw.Stop()
+	idle.Stop()
+	if err == nil {
+		CopyTrailer(w, resp)
+	}
 	if err != nil {
+		// the response is half written, nothing else can be done
 		L.Printf("Copy: %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if self.Transferred != nil && conn != nil {
+		self.Transferred(r.URL.Host, conn, n, time.Since(start))
+	}
+
 	d := BeautifyDuration(time.Since(start))
 	ndtos := BeautifySize(n)
 	L.Printf("RESPONSE %s %s in %s <-%s\n", r.URL.Host, resp.Status, d, ndtos)
@@ -92,63 +208,164 @@ func (self *Direct) Connect(w http.ResponseWriter, r *http.Request) (err error)
 	}
 	start := time.Now()
 
-	// Use Hijacker to get the underlying connection
-	hij, ok := w.(http.Hijacker)
-	if !ok {
-		s := "Server does not support Hijacker"
-		L.Println(s)
-		http.Error(w, s, http.StatusInternalServerError)
-		return
-	}
+	// waited on shutdown, the server forgets the connection once hijacked
+	t := Track(r)
+	defer t.Done()
 
 	// connect the remote client directly
-	dst, err := self.Tr.Dial("tcp", r.URL.Host)
+	dst, err := self.dial(r.Context(), "tcp", r.URL.Host)
 	if err != nil {
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() && self.Fallback != nil && Raced(r.Context()) {
 			L.Printf("RoundTrip: %s, reproxy...\n", err.Error())
 			err = ErrShouldProxy
 			return
 		}
 		L.Printf("Dial: %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		Fail(w, r, err)
 		return
 	}
-	defer dst.Close()
+	// dst may be switched to the fallback route
+	defer func() { dst.Close() }()
+	t.Add(dst)
 
-	src, _, err := hij.Hijack()
+	// Use Hijacker to get the underlying connection, or the HTTP/2 stream
+	src, err := Tunnel(w, r)
 	if err != nil {
-		L.Printf("Hijack: %s\n", err.Error())
+		L.Printf("Tunnel: %s\n", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer src.Close()
+	t.Add(src)
 
-	// Once connected successfully, return OK
-	src.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	// the client must be waited with deadline to detect interference
+	if self.Detector != nil && self.Fallback != nil && Raced(r.Context()) && src.SetReadDeadline(time.Time{}) == nil {
+		var first []byte
+		fallback := func(network, addr string) (net.Conn, error) {
+			return self.Fallback(r.Context(), network, addr)
+		}
+		dst, first, err = self.Detector.Handshake(src, dst, r.URL.Host, fallback)
+		if err != nil {
+			L.Printf("Handshake: %s\n", err.Error())
+			return
+		}
+		src.Write(first)
+		t.Add(dst)
+	}
 
 	// Proxy is no need to know anything, just exchange data between the client
 	// the the remote server.
-	copyAndWait := func(dst, src net.Conn, c chan int64) {
-		n, err := io.Copy(dst, src)
+	nstod, ndtos := self.splice(r, src, dst, outboundOf(RouteOf(r), Proxied(dst)))
+	if self.Transferred != nil {
+		self.Transferred(r.URL.Host, dst, ndtos, time.Since(start))
+	}
+
+	d := BeautifyDuration(time.Since(start))
+	L.Printf("CLOSE %s after %s ->%s <-%s\n",
+		r.URL.Host, d, BeautifySize(nstod), BeautifySize(ndtos))
+	return
+}
+
+// Data flow:
+//  1. Receive the 101 response of the upgrade request from the remote server
+//  2. Send the response to client through the hijacked connection
+//  3. Exchange data between client and server in the new protocol
+func (self *Direct) upgrade(w http.ResponseWriter, r *http.Request, resp *http.Response, start time.Time, outbound string) (err error) {
+	dst, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		s := "Upgraded body is not writable"
+		L.Println(s)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	t := Track(r)
+	defer t.Done()
+	t.Add(dst)
+
+	var src net.Conn
+	if r.ProtoMajor == 2 {
+		// extended CONNECT of HTTP/2 is accepted by 200, RFC 8441
+		CopyHeader(w, resp)
+		RemoveHopHeaders(w.Header())
+		w.Header().Del("Sec-Websocket-Accept")
+		if src, err = Tunnel(w, r); err != nil {
+			L.Printf("Tunnel: %s\n", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		hij, ok := w.(http.Hijacker)
+		if !ok {
+			s := "Server does not support Hijacker"
+			L.Println(s)
+			http.Error(w, s, http.StatusInternalServerError)
+			return
+		}
+		conn, brw, err := hij.Hijack()
+		if err != nil {
+			L.Printf("Hijack: %s\n", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		// relay the handshake, Connection and Upgrade are kept for the client
+		fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+		resp.Header.Write(brw)
+		brw.WriteString("\r\n")
+		if err = brw.Flush(); err != nil {
+			L.Printf("Write: %s\n", err.Error())
+			conn.Close()
+			return err
+		}
+		// client may have sent data after the request
+		src = &bufConn{Conn: conn, r: brw.Reader}
+	}
+	defer src.Close()
+	t.Add(src)
+
+	nstod, ndtos := self.splice(r, src, dst, outbound)
+
+	d := BeautifyDuration(time.Since(start))
+	L.Printf("CLOSE %s %s after %s ->%s <-%s\n", resp.Header.Get("Upgrade"),
+		r.URL.Host, d, BeautifySize(nstod), BeautifySize(ndtos))
+	return
+}
+
+// Exchange data between src and dst of request r until both sides are done,
+// or closed by the idle and lifetime timeouts, shaped by the bandwidth limits
+// of outbound. Returns bytes from src to dst and from dst to src.
+func (self *Direct) splice(r *http.Request, src, dst io.ReadWriteCloser, outbound string) (nstod, ndtos int64) {
+	wd := newWatchdog(self.Timeouts.Idle, self.Timeouts.Lifetime, func(reason string) {
+		L.Printf("TIMEOUT %s: %s\n", r.URL.Host, reason)
+		src.Close()
+		dst.Close()
+	})
+	defer wd.Stop()
+	sh := self.shaping(r, outbound)
+
+	copyAndWait := func(dst io.Writer, src io.Reader, m *Meter, c chan int64) {
+		n, err := copyConn(dst, src, wd, sh, m)
 		if err != nil {
 			L.Printf("Copy: %s\n", err.Error())
 			// FIXME: how to report error to dst ?
 		}
 		if tcpConn, ok := dst.(closeWriter); ok {
 			tcpConn.CloseWrite()
+		} else if c, ok := dst.(io.Closer); ok {
+			// can not half close, the other side is done too
+			c.Close()
 		}
 		c <- n
 	}
 
 	// client to remote
 	stod := make(chan int64)
-	go copyAndWait(dst, src, stod)
+	go copyAndWait(dst, src, self.meter(r, outbound, true), stod)
 
 	// remote to client
 	dtos := make(chan int64)
-	go copyAndWait(src, dst, dtos)
+	go copyAndWait(src, dst, self.meter(r, outbound, false), dtos)
 
-	var nstod, ndtos int64
 	for i := 0; i < 2; {
 		select {
 		case nstod = <-stod:
@@ -157,8 +374,5 @@ func (self *Direct) Connect(w http.ResponseWriter, r *http.Request) (err error)
 			i++
 		}
 	}
-	d := BeautifyDuration(time.Since(start))
-	L.Printf("CLOSE %s after %s ->%s <-%s\n",
-		r.URL.Host, d, BeautifySize(nstod), BeautifySize(ndtos))
 	return
 }
@@ -0,0 +1,407 @@
+package mallory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// max entries in DNS cache
+	dnsCacheSize = 4096
+	// TTL of cached answers which have no records
+	dnsDefaultTTL = 60 * time.Second
+	// timeout to exchange with the resolver
+	dnsTimeout = 5 * time.Second
+)
+
+// cached DNS answer
+type dnsEntry struct {
+	msg     []byte
+	created time.Time
+	expires time.Time
+}
+
+// DNS server, answers queries of blocked domains through the remote fetcher
+// and others through the direct resolver
+type DNS struct {
+	// pick outbound for domain names
+	Srv *Server
+	// resolver to query through the remote, default is 8.8.8.8:53
+	RemoteAddr string
+	// resolver to query directly, default is the system one
+	DirectAddr string
+	// answer cache
+	cache map[string]*dnsEntry
+	mutex sync.Mutex
+}
+
+// Create and initialize
+func NewDNS(srv *Server) *DNS {
+	self := &DNS{
+		Srv:        srv,
+		RemoteAddr: srv.Cfg.File.RemoteDNS,
+		DirectAddr: srv.Cfg.File.DirectDNS,
+		cache:      make(map[string]*dnsEntry),
+	}
+	if self.RemoteAddr == "" {
+		self.RemoteAddr = "8.8.8.8:53"
+	}
+	if self.DirectAddr == "" {
+		self.DirectAddr = systemResolver()
+	}
+	self.RemoteAddr = withPort(self.RemoteAddr, "53")
+	self.DirectAddr = withPort(self.DirectAddr, "53")
+	return self
+}
+
+// the first nameserver in /etc/resolv.conf
+func systemResolver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1]
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return addr
+}
+
+// Serve DNS queries on both UDP and TCP of addr
+func (self *DNS) ListenAndServe(addr string) error {
+	pc, err := ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	ln, err := Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	return self.Serve(pc, ln)
+}
+
+// Serve DNS queries on both pc and ln, they are closed once returned
+func (self *DNS) Serve(pc net.PacketConn, ln net.Listener) error {
+	defer pc.Close()
+	defer ln.Close()
+
+	errc := make(chan error, 2)
+	go func() { errc <- self.ServeUDP(pc) }()
+	go func() { errc <- self.ServeTCP(ln) }()
+	return <-errc
+}
+
+func (self *DNS) ServeUDP(pc net.PacketConn) error {
+	for {
+		buf := make([]byte, 65535)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			resp := self.Resolve(buf[:n])
+			if resp == nil {
+				return
+			}
+			resp = truncate(buf[:n], resp)
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				L.Printf("DNS WriteTo %s: %s\n", addr, err)
+			}
+		}()
+	}
+}
+
+func (self *DNS) ServeTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(2 * dnsTimeout))
+				query, err := readTCPMsg(conn)
+				if err != nil {
+					return
+				}
+				resp := self.Resolve(query)
+				if resp == nil {
+					return
+				}
+				if err = writeTCPMsg(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Resolve the raw query and returns the raw response, nil if the query is malformed
+func (self *DNS) Resolve(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		L.Printf("DNS Parse: %s\n", err)
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		L.Printf("DNS Parse: %s\n", err)
+		return nil
+	}
+
+	key := strings.ToLower(q.Name.String()) + q.Type.String() + q.Class.String()
+	if resp := self.lookup(key, h.ID); resp != nil {
+		return resp
+	}
+
+	host := strings.TrimSuffix(q.Name.String(), ".")
+	qtype := strings.TrimPrefix(q.Type.String(), "Type")
+	name, remote := self.Srv.RouteName(host)
+	start := time.Now()
+
+	var resp []byte
+	if remote == nil {
+		resp, err = exchange(net.Dial, "udp", self.DirectAddr, query)
+		if err == nil && self.Srv.Detector != nil && self.Srv.Detector.BogusAnswer(resp) {
+			self.Srv.Detector.Block(host, ErrBogusDNS)
+			name, remote = self.Srv.outbound(host, ProxyOutbound)
+		}
+	}
+	if remote != nil {
+		resp, err = exchange(remote.Dial, "tcp", self.RemoteAddr, query)
+	}
+	if err != nil {
+		L.Printf("[%s] DNS %s %s: %s\n", name, qtype, host, err)
+		return failure(query)
+	}
+	L.Printf("[%s] DNS %s %s in %s\n", name, qtype, host, BeautifyDuration(time.Since(start)))
+
+	self.store(key, resp)
+	return resp
+}
+
+// get the cached answer with the query ID, and TTLs minus the time elapsed
+func (self *DNS) lookup(key string, id uint16) []byte {
+	self.mutex.Lock()
+	e := self.cache[key]
+	self.mutex.Unlock()
+	if e == nil {
+		return nil
+	}
+	now := time.Now()
+	if now.After(e.expires) {
+		self.mutex.Lock()
+		delete(self.cache, key)
+		self.mutex.Unlock()
+		return nil
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(e.msg); err != nil {
+		return nil
+	}
+	m.ID = id
+	elapsed := uint32(now.Sub(e.created) / time.Second)
+	for _, rrs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range rrs {
+			if rrs[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if rrs[i].Header.TTL > elapsed {
+				rrs[i].Header.TTL -= elapsed
+			} else {
+				rrs[i].Header.TTL = 0
+			}
+		}
+	}
+	resp, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// cache the answer by the minimal TTL of its records
+func (self *DNS) store(key string, resp []byte) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return
+	}
+	if m.Truncated || (m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+
+	ttl := time.Duration(-1)
+	for _, rrs := range [][]dnsmessage.Resource{m.Answers, m.Authorities} {
+		for _, rr := range rrs {
+			if d := time.Duration(rr.Header.TTL) * time.Second; ttl < 0 || d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if ttl < 0 {
+		ttl = dnsDefaultTTL
+	}
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.cache) >= dnsCacheSize {
+		for k, e := range self.cache {
+			if now.After(e.expires) {
+				delete(self.cache, k)
+			}
+		}
+	}
+	// still full, drop some random entries
+	for k := range self.cache {
+		if len(self.cache) < dnsCacheSize {
+			break
+		}
+		delete(self.cache, k)
+	}
+	self.cache[key] = &dnsEntry{msg: resp, created: now, expires: now.Add(ttl)}
+}
+
+// send the query to addr and wait for the response
+func exchange(dial func(network, addr string) (net.Conn, error), network, addr string, query []byte) (resp []byte, err error) {
+	conn, err := dial(network, addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// channels of SSH do not support deadline, close it when timeout
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	timer := time.AfterFunc(dnsTimeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	if network == "tcp" {
+		if err = writeTCPMsg(conn, query); err != nil {
+			return
+		}
+		return readTCPMsg(conn)
+	}
+
+	if _, err = conn.Write(query); err != nil {
+		return
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	resp = buf[:n]
+
+	// the answer is too long for UDP, retry with TCP
+	var p dnsmessage.Parser
+	if h, err := p.Start(resp); err == nil && h.Truncated {
+		return exchange(dial, "tcp", addr, query)
+	}
+	return
+}
+
+// DNS over TCP message is prefixed with 2 bytes length
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMsg(w io.Writer, msg []byte) error {
+	if len(msg) > 65535 {
+		return errors.New("DNS message too long")
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// reply the query with SERVFAIL
+func failure(query []byte) []byte {
+	return reply(query, func(h *dnsmessage.Header) {
+		h.RCode = dnsmessage.RCodeServerFailure
+	})
+}
+
+// make sure the UDP response fits in the size the client accepts,
+// or reply with the TC bit to let the client retry with TCP
+func truncate(query, resp []byte) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err != nil {
+		return resp
+	}
+	size := 512
+	for _, rr := range m.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT && int(rr.Header.Class) > size {
+			size = int(rr.Header.Class)
+		}
+	}
+	if len(resp) <= size {
+		return resp
+	}
+	return reply(query, func(h *dnsmessage.Header) {
+		h.Truncated = true
+	})
+}
+
+// make an empty response to the query, only with the question
+func reply(query []byte, f func(h *dnsmessage.Header)) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	h.Response = true
+	h.RecursionAvailable = true
+	f(&h)
+	m := dnsmessage.Message{Header: h, Questions: qs}
+	resp, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
@@ -0,0 +1,280 @@
+package mallory
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// remote dialing directly, counts the dials
+type testRemote struct {
+	dials int32
+}
+
+func (self *testRemote) Dial(network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&self.dials, 1)
+	return net.Dial(network, addr)
+}
+
+func (self *testRemote) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	http.Error(w, "test remote", http.StatusBadGateway)
+	return nil
+}
+
+func (self *testRemote) Connect(w http.ResponseWriter, r *http.Request) error {
+	http.Error(w, "test remote", http.StatusBadGateway)
+	return nil
+}
+
+func (self *testRemote) Close() error {
+	return nil
+}
+
+// resolver answering A queries with ips, truncated over UDP if larger than
+// 512 bytes
+type testResolver struct {
+	addr     string
+	ips      []net.IP
+	ttl      uint32
+	udp, tcp int32
+}
+
+func newTestResolver(t *testing.T, ttl uint32, ips ...string) *testResolver {
+	self := &testResolver{ttl: ttl}
+	for _, ip := range ips {
+		self.ips = append(self.ips, net.ParseIP(ip))
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self.addr = pc.LocalAddr().String()
+	ln, err := net.Listen("tcp", self.addr)
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&self.udp, 1)
+			resp := self.answer(buf[:n])
+			if len(resp) > 512 {
+				resp = reply(buf[:n], func(h *dnsmessage.Header) { h.Truncated = true })
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&self.tcp, 1)
+			if query, err := readTCPMsg(conn); err == nil {
+				writeTCPMsg(conn, self.answer(query))
+			}
+			conn.Close()
+		}
+	}()
+	return self
+}
+
+func (self *testResolver) answer(query []byte) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err != nil {
+		return nil
+	}
+	m.Response, m.RecursionAvailable = true, true
+	m.Additionals = nil
+	for _, ip := range self.ips {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip.To4())
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET, TTL: self.ttl},
+			Body: &a,
+		})
+	}
+	resp, _ := m.Pack()
+	return resp
+}
+
+// A query of name, with EDNS of the UDP size if not 0
+func testQuery(id uint16, name string, size uint16) []byte {
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name),
+			Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	if size > 0 {
+		var opt dnsmessage.ResourceHeader
+		opt.SetEDNS0(int(size), dnsmessage.RCodeSuccess, false)
+		m.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+	query, _ := m.Pack()
+	return query
+}
+
+func unpackDNS(t *testing.T, resp []byte) *dnsmessage.Message {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatalf("unpack response: %s", err)
+	}
+	return &m
+}
+
+func TestDNSCache(t *testing.T) {
+	resolver := newTestResolver(t, 300, "198.51.100.1")
+	d := NewDNS(newTestServer(t, ""))
+	d.DirectAddr = resolver.addr
+
+	m := unpackDNS(t, d.Resolve(testQuery(1, "cached.example.", 0)))
+	if m.ID != 1 || len(m.Answers) != 1 || m.Answers[0].Header.TTL != 300 {
+		t.Fatalf("first answer: %+v", m)
+	}
+
+	// received 100s ago
+	d.mutex.Lock()
+	for _, e := range d.cache {
+		e.created = e.created.Add(-100 * time.Second)
+	}
+	d.mutex.Unlock()
+	m = unpackDNS(t, d.Resolve(testQuery(2, "Cached.Example.", 0)))
+	if m.ID != 2 {
+		t.Errorf("cached answer of ID %d, want 2", m.ID)
+	}
+	if ttl := m.Answers[0].Header.TTL; ttl != 200 {
+		t.Errorf("cached TTL %d, want 200", ttl)
+	}
+	if n := atomic.LoadInt32(&resolver.udp); n != 1 {
+		t.Errorf("resolver queried %d times, want 1", n)
+	}
+
+	// expired
+	d.mutex.Lock()
+	for _, e := range d.cache {
+		e.expires = time.Now().Add(-time.Second)
+	}
+	d.mutex.Unlock()
+	d.Resolve(testQuery(3, "cached.example.", 0))
+	if n := atomic.LoadInt32(&resolver.udp); n != 2 {
+		t.Errorf("resolver queried %d times after expired, want 2", n)
+	}
+}
+
+func TestDNSTruncate(t *testing.T) {
+	// too large for 512 bytes of UDP
+	var ips []string
+	for i := 1; i <= 100; i++ {
+		ips = append(ips, net.IPv4(198, 51, 100, byte(i)).String())
+	}
+	resolver := newTestResolver(t, 300, ips...)
+	d := NewDNS(newTestServer(t, ""))
+	d.DirectAddr = resolver.addr
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	go d.Serve(pc, ln)
+	defer pc.Close()
+
+	udp := func(query []byte) *dnsmessage.Message {
+		conn, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(query)
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return unpackDNS(t, buf[:n])
+	}
+
+	// truncated by the resolver, retried with TCP
+	m := udp(testQuery(1, "large.example.", 4096))
+	if m.Truncated || len(m.Answers) != len(ips) {
+		t.Errorf("EDNS of 4096: truncated %v with %d answers", m.Truncated, len(m.Answers))
+	}
+	if n := atomic.LoadInt32(&resolver.tcp); n != 1 {
+		t.Errorf("resolver queried by TCP %d times, want 1", n)
+	}
+
+	// larger than the client accepts
+	m = udp(testQuery(2, "large.example.", 0))
+	if !m.Truncated || len(m.Answers) != 0 || m.ID != 2 {
+		t.Errorf("no EDNS: truncated %v with %d answers", m.Truncated, len(m.Answers))
+	}
+	m = udp(testQuery(3, "large.example.", 1232))
+	if !m.Truncated {
+		t.Errorf("EDNS of 1232: not truncated")
+	}
+
+	// the client retries with TCP
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	writeTCPMsg(conn, testQuery(4, "large.example.", 0))
+	resp, err := readTCPMsg(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m = unpackDNS(t, resp); m.Truncated || len(m.Answers) != len(ips) || m.ID != 4 {
+		t.Errorf("TCP: truncated %v with %d answers", m.Truncated, len(m.Answers))
+	}
+}
+
+func TestDNSBogus(t *testing.T) {
+	poisoned := newTestResolver(t, 300, "192.0.2.99")
+	clean := newTestResolver(t, 300, "198.51.100.1")
+	srv := newTestServer(t, `"bogus": ["192.0.2.99"]`)
+	remote := &testRemote{}
+	srv.Remote = remote
+	d := NewDNS(srv)
+	d.DirectAddr, d.RemoteAddr = poisoned.addr, clean.addr
+
+	m := unpackDNS(t, d.Resolve(testQuery(1, "poisoned.example.", 0)))
+	if len(m.Answers) != 1 || net.IP(m.Answers[0].Body.(*dnsmessage.AResource).A[:]).String() != "198.51.100.1" {
+		t.Errorf("bogus answer is not replaced: %+v", m.Answers)
+	}
+	if !srv.Blocked("poisoned.example") {
+		t.Errorf("host of bogus answer is not blocked")
+	}
+
+	// queried through the remote from now on
+	delete(d.cache, "poisoned.example.TypeAClassINET")
+	d.Resolve(testQuery(2, "poisoned.example.", 0))
+	if n := atomic.LoadInt32(&poisoned.udp); n != 1 {
+		t.Errorf("poisoned resolver queried %d times, want 1", n)
+	}
+	if n, dials := atomic.LoadInt32(&clean.tcp), atomic.LoadInt32(&remote.dials); n != 2 || dials != 2 {
+		t.Errorf("remote resolver queried %d times by %d dials, want 2", n, dials)
+	}
+}
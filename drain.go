@@ -0,0 +1,134 @@
+package mallory
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// interval to check whether all tunnels are done
+	drainPollInterval = 100 * time.Millisecond
+)
+
+// context key of the tunnels to track
+type tunnelsKey struct{}
+
+// Tracked tunnel, the connections are closed if not done before the drain
+// deadline
+type Tracked struct {
+	mutex   sync.Mutex
+	closers []io.Closer
+	closed  bool
+	// remove from the tunnels once done
+	done func()
+}
+
+// Add c to close on drain, closed immediately if the deadline is reached
+func (self *Tracked) Add(c io.Closer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed {
+		c.Close()
+		return
+	}
+	self.closers = append(self.closers, c)
+}
+
+// Done must be called once the tunnel is done
+func (self *Tracked) Done() {
+	if self.done != nil {
+		self.done()
+	}
+}
+
+func (self *Tracked) close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.closed = true
+	for _, c := range self.closers {
+		c.Close()
+	}
+}
+
+// Tunnels tracks hijacked connections which are not known by http.Server,
+// e.g. CONNECT and upgraded ones, to drain them on shutdown
+type Tunnels struct {
+	mutex sync.Mutex
+	m     map[*Tracked]struct{}
+	// no more tunnels once closed
+	closed bool
+}
+
+func NewTunnels() *Tunnels {
+	return &Tunnels{m: make(map[*Tracked]struct{})}
+}
+
+// WithTunnels returns the context to track tunnels of the request in t
+func WithTunnels(ctx context.Context, t *Tunnels) context.Context {
+	return context.WithValue(ctx, tunnelsKey{}, t)
+}
+
+// Track the tunnel of request r before hijacking, so it is always waited
+// on shutdown
+func Track(r *http.Request) *Tracked {
+	t := &Tracked{}
+	self, ok := r.Context().Value(tunnelsKey{}).(*Tunnels)
+	if !ok {
+		return t
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed {
+		t.closed = true
+		return t
+	}
+	self.m[t] = struct{}{}
+	t.done = func() {
+		self.mutex.Lock()
+		delete(self.m, t)
+		self.mutex.Unlock()
+	}
+	return t
+}
+
+// Len returns the number of active tunnels
+func (self *Tunnels) Len() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return len(self.m)
+}
+
+// Drain waits all tunnels to be done until ctx is done, then closes the rest
+// and returns the error of ctx
+func (self *Tunnels) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for self.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			self.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Close all active tunnels, and the ones tracked later
+func (self *Tunnels) Close() {
+	self.mutex.Lock()
+	self.closed = true
+	m := self.m
+	self.m = make(map[*Tracked]struct{})
+	self.mutex.Unlock()
+
+	if len(m) > 0 {
+		L.Printf("Closing %d active tunnels\n", len(m))
+	}
+	for t := range m {
+		t.close()
+	}
+}
@@ -0,0 +1,171 @@
+package mallory
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Error of the remote server itself, not the destination host
+type RemoteError struct {
+	// address of the remote server
+	Addr string
+	Err  error
+}
+
+func (e *RemoteError) Error() string {
+	return "remote " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.Err
+}
+
+// context key of the route name
+type routeKey struct{}
+
+// WithRoute returns the context of request routed to the outbound name
+func WithRoute(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, routeKey{}, name)
+}
+
+// RouteOf returns the outbound name of request, empty if not routed
+func RouteOf(r *http.Request) string {
+	name, _ := r.Context().Value(routeKey{}).(string)
+	return name
+}
+
+// context key of the reason of route
+type reasonKey struct{}
+
+// WithReason returns the context of request routed for the reason, e.g.
+// "routes" or "default"
+func WithReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, reasonKey{}, reason)
+}
+
+// ReasonOf returns the reason of route in ctx, empty if not routed
+func ReasonOf(ctx context.Context) string {
+	reason, _ := ctx.Value(reasonKey{}).(string)
+	return reason
+}
+
+// Raced returns whether the request of ctx may leave through the remote
+// when connected directly, false if routed direct by config
+func Raced(ctx context.Context) bool {
+	reason := ReasonOf(ctx)
+	return reason == "" || reason == defaultReason
+}
+
+// Fail replies the client with the error page of the request failed by err,
+// status code is 502, 503 or 504 by the error, or 429 if limited
+func Fail(w http.ResponseWriter, r *http.Request, err error) {
+	code, status := proxyStatus(err)
+	ErrorPage(w, r, code, status, err)
+}
+
+// ErrorPage replies the client with the page of code and err, and the
+// Proxy-Status header of the error type, RFC 9209
+func ErrorPage(w http.ResponseWriter, r *http.Request, code int, status string, err error) {
+	route := RouteOf(r)
+	if route == "" {
+		route = "mallory"
+	}
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	reason := err.Error()
+
+	h := w.Header()
+	for k := range h {
+		h.Del(k)
+	}
+	h.Set("Proxy-Status", fmt.Sprintf("mallory; error=%s; details=%s", status, strconv.Quote(printable(reason))))
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) && limitErr.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(limitErr.RetryAfter.Seconds()))))
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body>\n", StatusText(code))
+		fmt.Fprintf(w, "<h1>%s</h1>\n<p>Failed to reach <b>%s</b> through <b>%s</b>.</p>\n<pre>%s</pre>\n</body></html>\n",
+			StatusText(code), html.EscapeString(host), html.EscapeString(route), html.EscapeString(reason))
+		return
+	}
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s\n\nFailed to reach %s through %s: %s\n", StatusText(code), host, route, reason)
+}
+
+// status code and Proxy-Status error type of err
+func proxyStatus(err error) (int, string) {
+	var limitErr *LimitError
+	var remoteErr *RemoteError
+	var dnsErr *net.DNSError
+	var chanErr *ssh.OpenChannelError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var nerr net.Error
+
+	switch {
+	case errors.As(err, &limitErr):
+		if limitErr.Code == http.StatusTooManyRequests {
+			return limitErr.Code, "http_request_denied"
+		}
+		return limitErr.Code, "connection_limit_reached"
+	case errors.As(err, &remoteErr):
+		return http.StatusServiceUnavailable, "destination_unavailable"
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return http.StatusGatewayTimeout, "dns_timeout"
+		}
+		return http.StatusBadGateway, "dns_error"
+	case errors.Is(err, ErrBogusDNS):
+		return http.StatusBadGateway, "dns_error"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return http.StatusGatewayTimeout, "connection_timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadGateway, "connection_terminated"
+	case errors.As(err, &chanErr):
+		return http.StatusBadGateway, "destination_unavailable"
+	case errors.As(err, &alertErr):
+		return http.StatusBadGateway, "tls_alert_received"
+	case errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return http.StatusBadGateway, "tls_certificate_error"
+	case errors.As(err, &recordErr):
+		return http.StatusBadGateway, "tls_protocol_error"
+	}
+	return http.StatusBadGateway, "proxy_internal_error"
+}
+
+// keep printable ASCII only for header value
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '?'
+		}
+		return r
+	}, s)
+}
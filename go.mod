@@ -1,6 +1,6 @@
 module github.com/justmao945/mallory
 
-go 1.17
+go 1.24
 
 require (
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
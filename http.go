@@ -1,9 +1,24 @@
 package mallory
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// max delay to flush the response body to client
+	flushInterval = 100 * time.Millisecond
 )
 
 // HostOnly returns host if has port in addr, or addr if missing port
@@ -30,30 +45,207 @@ func CopyHeader(w http.ResponseWriter, r *http.Response) {
 	}
 }
 
+// AnnounceTrailer adds the trailer names of r to the header of w, must be
+// called before the header is written
+func AnnounceTrailer(w http.ResponseWriter, r *http.Response) {
+	if len(r.Trailer) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(r.Trailer))
+	for k := range r.Trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.Header().Add("Trailer", strings.Join(keys, ", "))
+}
+
+// CopyTrailer copies trailers of r to w after the body is written, the ones
+// not announced are sent with http.TrailerPrefix
+func CopyTrailer(w http.ResponseWriter, r *http.Response) {
+	announced := w.Header()["Trailer"]
+	for k, vs := range r.Trailer {
+		if !hasToken(announced, k) {
+			k = http.TrailerPrefix + k
+		}
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+}
+
+// whether token is in the comma separated values, case insensitive
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Via returns the value of Via header for the message of protocol version, RFC 7230 section 5.7.1
+func Via(major, minor int) string {
+	if major >= 2 {
+		return strconv.Itoa(major) + " mallory"
+	}
+	return fmt.Sprintf("%d.%d mallory", major, minor)
+}
+
+// AddForwarded adds Via and X-Forwarded-For of the client to the request sent upstream
+func AddForwarded(r *http.Request) {
+	r.Header.Add("Via", Via(r.ProtoMajor, r.ProtoMinor))
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		r.Header.Set("X-Forwarded-For", ip)
+	}
+}
+
+// writer flushes the streaming response to client in time
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	// flush after every write if 0, or at most the delay
+	delay   time.Duration
+	timer   *time.Timer
+	stopped bool
+	mutex   sync.Mutex
+}
+
+// NewFlushWriter returns the writer to relay the body of r to w. Event
+// streams and bodies of unknown length, e.g. chunked, are flushed
+// immediately, others are flushed periodically. It must be stopped once
+// the body is written.
+func NewFlushWriter(w http.ResponseWriter, r *http.Response) *flushWriter {
+	self := &flushWriter{w: w, delay: flushInterval}
+	self.flusher, _ = w.(http.Flusher)
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "text/event-stream" || r.ContentLength == -1 {
+		self.delay = 0
+	}
+	return self
+}
+
+func (self *flushWriter) Write(b []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	n, err := self.w.Write(b)
+	if err != nil || self.flusher == nil {
+		return n, err
+	}
+	if self.delay == 0 {
+		self.flusher.Flush()
+	} else if self.timer == nil {
+		self.timer = time.AfterFunc(self.delay, self.flush)
+	}
+	return n, nil
+}
+
+func (self *flushWriter) flush() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.stopped {
+		self.flusher.Flush()
+	}
+	self.timer = nil
+}
+
+// Stop flushing, the writer is not used after
+func (self *flushWriter) Stop() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.stopped = true
+	if self.timer != nil {
+		self.timer.Stop()
+	}
+}
+
 // StatusText returns http status text looks like "200 OK"
 func StatusText(c int) string {
 	return fmt.Sprintf("%d %s", c, http.StatusText(c))
 }
 
-// Hop-by-hop headers. These are removed when sent to the backend.
-// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+// Hop-by-hop headers. These are removed when sent to the backend or client.
+// https://tools.ietf.org/html/rfc7230#section-6.1
 var hopHeaders = []string{
-	// If no Accept-Encoding header exists, Transport will add the headers it can accept
-	// and would wrap the response body with the relevant reader.
-	"Accept-Encoding",
 	"Connection",
 	"Keep-Alive",
 	"Proxy-Authenticate",
 	"Proxy-Authorization",
 	"Te", // canonicalized version of "TE"
-	"Trailers",
+	"Trailer",
 	"Transfer-Encoding",
 	"Upgrade",
 	"Proxy-Connection", // added by CURL  http://homepage.ntlworld.com/jonathan.deboynepollard/FGA/web-proxy-connection-header.html
 }
 
+// UpgradeType returns the protocol to upgrade to, e.g. websocket, empty if
+// the request is not an upgrade one
+func UpgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// RemoveHopHeaders removes hop-by-hop headers of request or response, including
+// the ones listed in Connection header. "TE: trailers" is kept to tell the
+// server that trailers are accepted, e.g. gRPC.
 func RemoveHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = textproto.TrimString(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	trailers := hasToken(h["Te"], "trailers")
 	for _, k := range hopHeaders {
 		h.Del(k)
 	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// Idempotent returns whether the method is idempotent, RFC 7231 section 4.2.2
+func Idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// BufferBody reads the body of r into memory if it's not larger than limit,
+// so the request can be sent again by GetBody. Returns false if too large,
+// the body is still intact but can only be read once.
+func BufferBody(r *http.Request, limit int64) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > limit {
+		return false
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return false
+	}
+	r.Body.Close()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true
 }
@@ -0,0 +1,167 @@
+package mallory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// smart server of the config, hosts of test servers are connected directly
+func newTestServer(t *testing.T, conf string) *Server {
+	path := filepath.Join(t.TempDir(), "mallory.json")
+	if conf != "" {
+		conf = ", " + conf
+	}
+	conf = `{"remote": "http://127.0.0.1:1", "routes": {"127.0.0.1": "direct"}` + conf + `}`
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(SmartSrv, c, NewLimiter(c), NewShaper(c), NewUsage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// client of the proxy serving by srv
+func newTestClient(t *testing.T, srv http.Handler) *http.Client {
+	proxy := httptest.NewServer(srv)
+	t.Cleanup(proxy.Close)
+	u, _ := url.Parse(proxy.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(u)}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr}
+}
+
+// request header received by the server through the proxy
+func forwardedHeader(t *testing.T, client *http.Client, header http.Header) http.Header {
+	got := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	req, _ := http.NewRequest("GET", upstream.URL, nil)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return <-got
+}
+
+func TestForwarded(t *testing.T) {
+	// clients are not revealed by default
+	client := newTestClient(t, newTestServer(t, ""))
+	h := forwardedHeader(t, client, nil)
+	if h.Get("Via") != "" || h.Get("X-Forwarded-For") != "" {
+		t.Errorf("forwarded by default: Via %q, X-Forwarded-For %q", h.Get("Via"), h.Get("X-Forwarded-For"))
+	}
+
+	client = newTestClient(t, newTestServer(t, `"forwarded": true`))
+	h = forwardedHeader(t, client, nil)
+	if h.Get("Via") != "1.1 mallory" || h.Get("X-Forwarded-For") != "127.0.0.1" {
+		t.Errorf("forwarded: Via %q, X-Forwarded-For %q", h.Get("Via"), h.Get("X-Forwarded-For"))
+	}
+	// appended to the prior proxies
+	h = forwardedHeader(t, client, http.Header{"Via": {"1.0 corp"}, "X-Forwarded-For": {"10.0.0.1"}})
+	if v := h.Values("Via"); len(v) != 2 || v[0] != "1.0 corp" || v[1] != "1.1 mallory" {
+		t.Errorf("forwarded by proxy: Via %q", v)
+	}
+	if v := h.Get("X-Forwarded-For"); v != "10.0.0.1, 127.0.0.1" {
+		t.Errorf("forwarded by proxy: X-Forwarded-For %q", v)
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	for te, trailers := range map[string]bool{"trailers": true, "deflate, Trailers": true, "deflate": false} {
+		h := http.Header{
+			"Connection":       {"X-Foo, x-bar", "X-BAZ"},
+			"X-Foo":            {"1"},
+			"X-Bar":            {"1"},
+			"X-Baz":            {"1"},
+			"Te":               {te},
+			"Keep-Alive":       {"timeout=5"},
+			"Proxy-Connection": {"keep-alive"},
+			"Accept-Encoding":  {"br"},
+		}
+		RemoveHopHeaders(h)
+		want := http.Header{"Accept-Encoding": {"br"}}
+		if trailers {
+			want.Set("Te", "trailers")
+		}
+		if !reflect.DeepEqual(h, want) {
+			t.Errorf("TE %q: %v, want %v", te, h, want)
+		}
+	}
+}
+
+func TestRemoveHopHeadersProxied(t *testing.T) {
+	got := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+		h := w.Header()
+		h.Set("Connection", "X-Hop, x-other")
+		h.Set("X-Hop", "1")
+		h.Set("X-Other", "1")
+		h.Set("Keep-Alive", "timeout=5")
+		h.Set("Proxy-Authenticate", `Basic realm="corp"`)
+		h.Set("Proxy-Connection", "keep-alive")
+		h.Set("X-End", "1")
+	}))
+	defer upstream.Close()
+	client := newTestClient(t, newTestServer(t, ""))
+
+	for te, want := range map[string]string{"trailers": "trailers", "trailers, deflate": "trailers", "gzip": ""} {
+		req, _ := http.NewRequest("GET", upstream.URL, nil)
+		req.Header = http.Header{
+			"Connection":          {"X-Foo,x-BAR", "keep-alive"},
+			"X-Foo":               {"1"},
+			"X-Bar":               {"1"},
+			"X-End":               {"1"},
+			"Te":                  {te},
+			"Accept-Encoding":     {"br"},
+			"Keep-Alive":          {"timeout=5"},
+			"Proxy-Authorization": {"Basic eDp5"},
+			"Proxy-Connection":    {"keep-alive"},
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		h := <-got
+		for _, k := range []string{"X-Foo", "X-Bar", "Keep-Alive", "Proxy-Authorization", "Proxy-Connection"} {
+			if v, ok := h[k]; ok {
+				t.Errorf("TE %q: request header %s: %q is sent", te, k, v)
+			}
+		}
+		if h.Get("Te") != want {
+			t.Errorf("TE %q: sent as %q, want %q", te, h.Get("Te"), want)
+		}
+		if h.Get("Accept-Encoding") != "br" || h.Get("X-End") != "1" {
+			t.Errorf("TE %q: end-to-end request header is lost: %v", te, h)
+		}
+
+		for _, k := range []string{"X-Hop", "X-Other", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection"} {
+			if v, ok := resp.Header[k]; ok {
+				t.Errorf("response header %s: %q is sent", k, v)
+			}
+		}
+		if resp.Header.Get("X-End") != "1" {
+			t.Errorf("end-to-end response header is lost: %v", resp.Header)
+		}
+	}
+}
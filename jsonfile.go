@@ -0,0 +1,28 @@
+package mallory
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// Load the JSON file at path into v, v is kept as is if the file does not
+// exist
+func loadJSON(path string, v interface{}) error {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// Save buf to path, written to a temp file first to never leave a broken file
+func saveFile(path string, buf []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
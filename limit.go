@@ -0,0 +1,195 @@
+package mallory
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limits of clients and destinations, zero for unlimited
+type Limits struct {
+	// concurrent tunnels of a client
+	ClientTunnels int
+	// concurrent tunnels to a host
+	HostTunnels int
+	// requests per second of a client
+	ClientRate float64
+	// requests per second to a host
+	HostRate float64
+	// requests allowed in a burst above the rates
+	Burst int
+	// concurrent channels over an SSH server
+	SSHChannels int
+}
+
+// Error of exceeded limits, replied with Code and Retry-After
+type LimitError struct {
+	// 429 if the client is limited, 503 if the host or remote
+	Code int
+	// what is limited
+	Reason string
+	// time to try again, zero if unknown
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return e.Reason
+}
+
+// Limiter counts concurrent tunnels and request rates of clients and hosts,
+// and channels of SSH servers. Limits are read from config each time, so
+// they are changed once reloaded.
+type Limiter struct {
+	Cfg *Config
+	// concurrent tunnels or channels by key
+	counts map[string]int
+	// request rates by key
+	buckets buckets
+	mutex   sync.Mutex
+}
+
+// Create limiter of the limits in c
+func NewLimiter(c *Config) *Limiter {
+	return &Limiter{
+		Cfg:    c,
+		counts: make(map[string]int),
+	}
+}
+
+// context key of the client of request
+type clientKey struct{}
+
+// WithClient returns the context of request from client, which is kept after
+// Proxy-Authorization is removed
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientOf returns the client of r in the context, or the client IP
+func ClientOf(r *http.Request) string {
+	if client, ok := r.Context().Value(clientKey{}).(string); ok {
+		return client
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// take a token from the bucket of key, returns the time to wait if empty
+func (self *Limiter) take(key string, rate float64, burst int, now time.Time) time.Duration {
+	b := self.buckets.get(key, now)
+	b.refill(rate, float64(burst), now)
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// Request takes a token of the request rates of client and host
+func (self *Limiter) Request(client, host string) error {
+	l := self.Cfg.Limits()
+	now := time.Now()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if l.ClientRate > 0 {
+		if d := self.take("client "+client, l.ClientRate, l.Burst, now); d > 0 {
+			return &LimitError{http.StatusTooManyRequests,
+				fmt.Sprintf("client %s exceeds %g requests/s", client, l.ClientRate), d}
+		}
+	}
+	if l.HostRate > 0 {
+		if d := self.take("host "+host, l.HostRate, l.Burst, now); d > 0 {
+			return &LimitError{http.StatusServiceUnavailable,
+				fmt.Sprintf("host %s exceeds %g requests/s", host, l.HostRate), d}
+		}
+	}
+	return nil
+}
+
+// count one more of key if less than max
+func (self *Limiter) acquire(key string, max int) bool {
+	if max > 0 && self.counts[key] >= max {
+		return false
+	}
+	self.counts[key]++
+	return true
+}
+
+// count one less of key
+func (self *Limiter) release(key string) {
+	if self.counts[key]--; self.counts[key] <= 0 {
+		delete(self.counts, key)
+	}
+}
+
+// returns the func to release keys once
+func (self *Limiter) releaser(keys ...string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			self.mutex.Lock()
+			for _, key := range keys {
+				self.release(key)
+			}
+			self.mutex.Unlock()
+		})
+	}
+}
+
+// Tunnel counts a concurrent tunnel of client to host, returns the func to
+// call once the tunnel is done
+func (self *Limiter) Tunnel(client, host string) (release func(), err error) {
+	l := self.Cfg.Limits()
+	ckey, hkey := "client "+client, "host "+host
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.acquire(ckey, l.ClientTunnels) {
+		return nil, &LimitError{Code: http.StatusTooManyRequests,
+			Reason: fmt.Sprintf("client %s exceeds %d tunnels", client, l.ClientTunnels)}
+	}
+	if !self.acquire(hkey, l.HostTunnels) {
+		self.release(ckey)
+		return nil, &LimitError{Code: http.StatusServiceUnavailable,
+			Reason: fmt.Sprintf("host %s exceeds %d tunnels", host, l.HostTunnels)}
+	}
+	return self.releaser(ckey, hkey), nil
+}
+
+// Channel counts a channel over the SSH server addr, returns the func to
+// call once the channel is closed
+func (self *Limiter) Channel(addr string) (release func(), err error) {
+	l := self.Cfg.Limits()
+	key := "ssh " + addr
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.acquire(key, l.SSHChannels) {
+		return nil, &LimitError{Code: http.StatusServiceUnavailable,
+			Reason: fmt.Sprintf("ssh %s exceeds %d channels", addr, l.SSHChannels)}
+	}
+	return self.releaser(key), nil
+}
+
+// connection to release the limit once closed
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (self *limitedConn) Close() error {
+	self.release()
+	return self.Conn.Close()
+}
+
+// half close is kept for tunnels
+func (self *limitedConn) CloseWrite() error {
+	if cw, ok := self.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return self.Conn.Close()
+}
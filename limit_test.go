@@ -0,0 +1,49 @@
+package mallory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// request with Proxy-Authorization of user and password, none if user is empty
+func proxyAuthRequest(url, user, passwd string) *http.Request {
+	r := httptest.NewRequest("GET", url, nil)
+	if user != "" {
+		pr := &http.Request{Header: make(http.Header)}
+		pr.SetBasicAuth(user, passwd)
+		r.Header.Set("Proxy-Authorization", pr.Header.Get("Authorization"))
+	}
+	return r
+}
+
+func TestClientRateByUser(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	srv := newTestServer(t, `"client_rate": 0.001, "rate_burst": 1, "users": {"alice": "a", "bob": "b"}`)
+
+	get := func(user, passwd string) int {
+		r := proxyAuthRequest(upstream.URL, user, passwd)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w.Code
+	}
+	// verified users have their own limits
+	if code := get("alice", "a"); code != 404 {
+		t.Errorf("alice: %d", code)
+	}
+	if code := get("bob", "b"); code != 404 {
+		t.Errorf("bob: %d", code)
+	}
+	// unverified names share the limit of the IP
+	if code := get("carol", "c"); code != 404 {
+		t.Errorf("carol: %d", code)
+	}
+	if code := get("dave", "d"); code != http.StatusTooManyRequests {
+		t.Errorf("dave: %d, want 429", code)
+	}
+	if code := get("alice", "b"); code != http.StatusTooManyRequests {
+		t.Errorf("alice of wrong password: %d, want 429", code)
+	}
+}
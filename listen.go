@@ -0,0 +1,257 @@
+package mallory
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// number of listening sockets handed over by the old process, from fd 3
+	envListenFDs = "MALLORY_LISTEN_FDS"
+	// pipe to tell the old process that the new one is ready
+	envReadyFD = "MALLORY_READY_FD"
+	// time to wait the new process to be ready on upgrade
+	upgradeTimeout = time.Minute
+)
+
+// socket which can be handed over to another process
+type filer interface {
+	File() (*os.File, error)
+}
+
+var sockets = struct {
+	// sockets inherited from the old process or systemd, not used yet
+	inherited []filer
+	// sockets listening now, to hand over on upgrade
+	active []filer
+	once   sync.Once
+	mutex  sync.Mutex
+}{}
+
+// load the sockets passed by the old process, or by systemd socket activation
+func inherit() {
+	n, _ := strconv.Atoi(os.Getenv(envListenFDs))
+	if n == 0 && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		n, _ = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	}
+	// never pass them to children
+	for _, k := range []string{envListenFDs, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(k)
+	}
+
+	for fd := 3; fd < 3+n; fd++ {
+		f := os.NewFile(uintptr(fd), "listener")
+		// the socket is duplicated by net, the file is no longer needed
+		if ln, err := net.FileListener(f); err == nil {
+			sockets.inherited = append(sockets.inherited, ln.(filer))
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			sockets.inherited = append(sockets.inherited, pc.(filer))
+		} else {
+			L.Printf("Inherited fd %d is not a socket: %s\n", fd, err)
+		}
+		f.Close()
+	}
+	if n > 0 {
+		L.Printf("Inherited %d listening sockets\n", len(sockets.inherited))
+	}
+}
+
+// take the inherited socket listening on network and addr, nil if not found
+func takeInherited(network, addr string) filer {
+	sockets.once.Do(inherit)
+	sockets.mutex.Lock()
+	defer sockets.mutex.Unlock()
+	for i, s := range sockets.inherited {
+		var a net.Addr
+		switch s := s.(type) {
+		case net.Listener:
+			a = s.Addr()
+		case net.PacketConn:
+			a = s.LocalAddr()
+		}
+		if sameAddr(a, network, addr) {
+			sockets.inherited = append(sockets.inherited[:i], sockets.inherited[i+1:]...)
+			return s
+		}
+	}
+	return nil
+}
+
+// test whether the local address a is the one to listen on network and addr
+func sameAddr(a net.Addr, network, addr string) bool {
+	var ip net.IP
+	var port int
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		if !strings.HasPrefix(network, "tcp") {
+			return false
+		}
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		if !strings.HasPrefix(network, "udp") {
+			return false
+		}
+		ip, port = a.IP, a.Port
+	default:
+		return false
+	}
+
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if pn, err := net.LookupPort(network, p); err != nil || pn != port {
+		return false
+	}
+	switch {
+	case host == "":
+		return ip.IsUnspecified()
+	case host == "localhost":
+		return ip.IsLoopback()
+	}
+	return ip.Equal(net.ParseIP(host))
+}
+
+// Listen on the TCP addr, the socket is reused if inherited from the old
+// process or systemd
+func Listen(network, addr string) (ln net.Listener, err error) {
+	if s := takeInherited(network, addr); s != nil {
+		ln = s.(net.Listener)
+	} else if ln, err = net.Listen(network, addr); err != nil {
+		return
+	}
+	sockets.mutex.Lock()
+	sockets.active = append(sockets.active, ln.(filer))
+	sockets.mutex.Unlock()
+	return
+}
+
+// ListenPacket on the UDP addr, the socket is reused if inherited from the
+// old process or systemd
+func ListenPacket(network, addr string) (pc net.PacketConn, err error) {
+	if s := takeInherited(network, addr); s != nil {
+		pc = s.(net.PacketConn)
+	} else if pc, err = net.ListenPacket(network, addr); err != nil {
+		return
+	}
+	sockets.mutex.Lock()
+	sockets.active = append(sockets.active, pc.(filer))
+	sockets.mutex.Unlock()
+	return
+}
+
+// Ready tells the old process and systemd that this process is serving,
+// inherited sockets not listened again are closed
+func Ready() {
+	sockets.once.Do(inherit)
+	sockets.mutex.Lock()
+	for _, s := range sockets.inherited {
+		L.Printf("Close unused inherited socket\n")
+		s.(interface{ Close() error }).Close()
+	}
+	sockets.inherited = nil
+	sockets.mutex.Unlock()
+
+	if fd, err := strconv.Atoi(os.Getenv(envReadyFD)); err == nil {
+		os.Unsetenv(envReadyFD)
+		f := os.NewFile(uintptr(fd), "ready")
+		f.Write([]byte{1})
+		f.Close()
+	}
+	if err := notify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+		L.Printf("Notify systemd: %s\n", err)
+	}
+}
+
+// Upgrade starts the executable again with the listening sockets, and waits
+// until it's ready to serve. The caller should drain and exit then.
+func Upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	sockets.mutex.Lock()
+	var files []*os.File
+	for _, s := range sockets.active {
+		f, err := s.File()
+		if err != nil {
+			sockets.mutex.Unlock()
+			return err
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	sockets.mutex.Unlock()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envListenFDs+"=") && !strings.HasPrefix(kv, envReadyFD+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("%s=%d", envListenFDs, len(files)),
+		fmt.Sprintf("%s=%d", envReadyFD, 3+len(files)))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	L.Printf("Started new process %d with %d sockets\n", cmd.Process.Pid, len(files))
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// the pipe is closed without data if the new process failed
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	buf := make([]byte, 1)
+	if n, err := r.Read(buf); n == 0 {
+		select {
+		case err = <-exited:
+			return fmt.Errorf("new process exited: %v", err)
+		case <-time.After(time.Second):
+		}
+		cmd.Process.Kill()
+		if err == nil {
+			err = errors.New("new process is not ready")
+		}
+		return err
+	}
+	return nil
+}
+
+// send state to systemd, the service should be Type=notify and NotifyAccess=all
+// to allow the new process to be the main one
+func notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,97 @@
+package mallory
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRU cache, entries expire after TTL
+type LRU struct {
+	// max entries
+	Size int
+	// time to live of entries
+	TTL   time.Duration
+	list  *list.List
+	items map[string]*list.Element
+	mutex sync.Mutex
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// Create and initialize
+func NewLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{
+		Size:  size,
+		TTL:   ttl,
+		list:  list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get value of key, ok is false if not found or expired
+func (self *LRU) Get(key string) (value interface{}, ok bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	el := self.items[key]
+	if el == nil {
+		return
+	}
+	e := el.Value.(*lruEntry)
+	if time.Now().After(e.expires) {
+		self.remove(el)
+		return
+	}
+	self.list.MoveToFront(el)
+	return e.value, true
+}
+
+// Set value of key, the least recently used one is dropped if full
+func (self *LRU) Set(key string, value interface{}) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	expires := time.Now().Add(self.TTL)
+	if el := self.items[key]; el != nil {
+		e := el.Value.(*lruEntry)
+		e.value, e.expires = value, expires
+		self.list.MoveToFront(el)
+		return
+	}
+	self.items[key] = self.list.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for self.list.Len() > self.Size {
+		self.remove(self.list.Back())
+	}
+}
+
+// Delete key
+func (self *LRU) Delete(key string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if el := self.items[key]; el != nil {
+		self.remove(el)
+	}
+}
+
+// Remove all entries
+func (self *LRU) Clear() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.list.Init()
+	self.items = make(map[string]*list.Element)
+}
+
+// Number of entries, including the expired ones not removed yet
+func (self *LRU) Len() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.list.Len()
+}
+
+func (self *LRU) remove(el *list.Element) {
+	self.list.Remove(el)
+	delete(self.items, el.Value.(*lruEntry).key)
+}
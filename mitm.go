@@ -0,0 +1,242 @@
+package mallory
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// max certificates of hosts in cache
+	mitmCacheSize = 1024
+	// certificates of hosts are valid in this duration, browsers accept 398 days at most
+	mitmCertValidity = 397 * 24 * time.Hour
+)
+
+// Intercept HTTPS with certificates signed by the local CA on the fly
+type MITM struct {
+	// CA certificate
+	CA *x509.Certificate
+	// CA private key
+	Key crypto.Signer
+	// private key shared by certificates of all hosts
+	leafKey *ecdsa.PrivateKey
+	// host to *tls.Certificate
+	certs *LRU
+	// only sign once for a host
+	sf Group
+}
+
+// Load the CA from files, or generate them if not exist
+func NewMITM(certPath, keyPath string) (self *MITM, err error) {
+	self = &MITM{certs: NewLRU(mitmCacheSize, mitmCertValidity/2)}
+	if _, err = os.Stat(certPath); os.IsNotExist(err) {
+		// the new process may generate it at the same time on upgrade
+		if err = generateCA(certPath, keyPath); err == nil {
+			L.Printf("Generated CA %s, trust it in clients to intercept HTTPS\n", certPath)
+		} else if !os.IsExist(err) {
+			return
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return
+	}
+	self.CA, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key of CA " + keyPath)
+	}
+	self.Key = key
+	self.leafKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return
+}
+
+// generate a new CA, never overwrite the existing files
+func generateCA(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "mallory CA", Organization: []string{"mallory"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = writePEM(keyPath, "EC PRIVATE KEY", keyDer, 0600)
+	if err != nil {
+		return err
+	}
+	return writePEM(certPath, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(path, typ string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: typ, Bytes: der})
+}
+
+// Get the certificate of host signed by CA
+func (self *MITM) Certificate(host string) (*tls.Certificate, error) {
+	if v, ok := self.certs.Get(host); ok {
+		return v.(*tls.Certificate), nil
+	}
+	v, err := self.sf.Do(host, func() (interface{}, error) {
+		return self.sign(host)
+	})
+	if err != nil {
+		return nil, err
+	}
+	cert := v.(*tls.Certificate)
+	self.certs.Set(host, cert)
+	return cert, nil
+}
+
+func (self *MITM) sign(host string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host, Organization: []string{"mallory"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(mitmCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, self.CA, &self.leafKey.PublicKey, self.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, self.CA.Raw},
+		PrivateKey:  self.leafKey,
+	}, nil
+}
+
+// Serve HTTP requests from the hijacked client conn after TLS handshake,
+// host is the one in CONNECT request.
+func (self *MITM) Serve(conn net.Conn, host string, handler http.Handler) error {
+	tc := tls.Server(conn, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// only the host allowed in CONNECT is signed, never any name of SNI
+			name := HostOnly(host)
+			if sni := hello.ServerName; sni != "" && !strings.EqualFold(sni, name) {
+				return nil, fmt.Errorf("SNI %s is not the host %s in CONNECT", sni, name)
+			}
+			return self.Certificate(name)
+		},
+	})
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return err
+	}
+
+	ln := newConnListener(tc)
+	var hijacked int32
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.ServeHTTP(w, r)
+			// the conn is used by handler until it returns, e.g. WebSocket
+			if atomic.LoadInt32(&hijacked) == 1 {
+				ln.Close()
+			}
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateHijacked {
+				atomic.StoreInt32(&hijacked, 1)
+			} else if state == http.StateClosed {
+				ln.Close()
+			}
+		},
+		ErrorLog: L,
+	}
+	err := srv.Serve(ln)
+	if err == errListenerClosed {
+		err = nil
+	}
+	return err
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+// listener accepts the only one conn
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, done: make(chan struct{})}
+}
+
+func (self *connListener) Accept() (net.Conn, error) {
+	if c := self.conn; c != nil {
+		self.conn = nil
+		return c, nil
+	}
+	<-self.done
+	return nil, errListenerClosed
+}
+
+func (self *connListener) Close() error {
+	self.once.Do(func() { close(self.done) })
+	return nil
+}
+
+func (self *connListener) Addr() net.Addr {
+	return dummyAddr("mitm")
+}
+
+type dummyAddr string
+
+func (a dummyAddr) Network() string { return string(a) }
+func (a dummyAddr) String() string  { return string(a) }
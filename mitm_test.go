@@ -0,0 +1,110 @@
+package mallory
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMITMServeSNI(t *testing.T) {
+	dir := t.TempDir()
+	mitm, err := NewMITM(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(mitm.CA)
+
+	for sni, ok := range map[string]bool{"a.example": true, "A.Example": true, "": true, "b.example": false} {
+		client, src := tcpPair(t)
+		done := make(chan error, 1)
+		go func() {
+			done <- mitm.Serve(src, "a.example:443", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, r.Host)
+			}))
+		}()
+
+		tc := tls.Client(client, &tls.Config{ServerName: sni, RootCAs: roots, InsecureSkipVerify: sni == ""})
+		err := tc.Handshake()
+		if ok != (err == nil) {
+			t.Errorf("SNI %q: handshake error %v", sni, err)
+		}
+		if err == nil {
+			if names := tc.ConnectionState().PeerCertificates[0].DNSNames; len(names) != 1 || names[0] != "a.example" {
+				t.Errorf("SNI %q: certificate of %v", sni, names)
+			}
+			fmt.Fprintf(tc, "GET / HTTP/1.1\r\nHost: a.example\r\nConnection: close\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+			if err != nil || resp.StatusCode != 200 {
+				t.Errorf("SNI %q: response %v, %v", sni, resp, err)
+			}
+		}
+		tc.Close()
+		<-done
+	}
+}
+
+func TestConfigMITMReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mallory.json")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{}`)
+	c, err := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MITM() != nil {
+		t.Fatal("CA is loaded without the mitm list")
+	}
+
+	// the CA can not be written, the old config is kept
+	ca := filepath.Join(dir, "ca", "ca.pem")
+	key := filepath.Join(dir, "ca", "ca.key")
+	write(fmt.Sprintf(`{"mitm": ["*.example"], "mitm_cert": %q, "mitm_key": %q}`, ca, key))
+	if err = c.Reload(); err == nil || c.MITM() != nil || c.Intercepted("a.example") {
+		t.Fatalf("reload with broken CA: %v", err)
+	}
+
+	// fixed once reloaded
+	os.Mkdir(filepath.Join(dir, "ca"), 0755)
+	if err = c.Reload(); err != nil || c.MITM() == nil {
+		t.Fatalf("reload with CA: %v", err)
+	}
+	mitm := c.MITM()
+	if err = c.Reload(); err != nil || c.MITM() != mitm {
+		t.Errorf("CA is loaded again: %v", err)
+	}
+}
+
+func TestInterceptClient(t *testing.T) {
+	dir := t.TempDir()
+	// the only token of alice is taken by CONNECT
+	srv := newTestServer(t, fmt.Sprintf(`"mitm": ["intercepted.example"], "mitm_cert": %q, "mitm_key": %q,
+		"client_rate": 0.001, "rate_burst": 1, "users": {"alice": "a"}`,
+		filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")))
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Cfg.MITM().CA)
+
+	client := newTestClient(t, srv)
+	tr := client.Transport.(*http.Transport)
+	tr.TLSClientConfig = &tls.Config{RootCAs: roots}
+	tr.ProxyConnectHeader = proxyAuthRequest("http://intercepted.example/", "alice", "a").Header
+
+	resp, err := client.Get("https://intercepted.example/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("decrypted request: %d, want 429 as alice", resp.StatusCode)
+	}
+}
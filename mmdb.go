@@ -0,0 +1,360 @@
+package mallory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+const (
+	// max nesting of maps and arrays, loops of pointers are stopped by it
+	mmdbMaxDepth = 64
+)
+
+var (
+	// marker before the metadata section
+	mmdbMetadataStart = []byte("\xAB\xCD\xEFMaxMind.com")
+
+	ErrInvalidMMDB = errors.New("invalid MaxMind DB")
+)
+
+// Reader of MaxMind DB file, e.g. GeoLite2-Country.mmdb or GeoLite2-ASN.mmdb
+// See https://maxmind.github.io/MaxMind-DB/
+type MMDB struct {
+	// database type in metadata, e.g. GeoLite2-Country
+	Type string
+	// 4 or 6
+	IPVersion int
+	// number of nodes in search tree
+	NodeCount uint
+	// 24, 28 or 32 bits of each record
+	RecordSize uint
+	// whole file content
+	buf []byte
+	// data section
+	data []byte
+	// node to start searching IPv4 address in IPv6 tree
+	ipv4Start uint
+}
+
+// Load the whole database file
+func OpenMMDB(path string) (self *MMDB, err error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	self = &MMDB{buf: buf}
+
+	i := bytes.LastIndex(buf, mmdbMetadataStart)
+	if i < 0 {
+		return nil, ErrInvalidMMDB
+	}
+	meta := buf[i+len(mmdbMetadataStart):]
+	v, _, err := (&mmdbDecoder{buf: meta}).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidMMDB
+	}
+	self.Type, _ = m["database_type"].(string)
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	self.NodeCount, self.RecordSize, self.IPVersion = uint(nodeCount), uint(recordSize), int(ipVersion)
+	if self.RecordSize != 24 && self.RecordSize != 28 && self.RecordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d of MaxMind DB", self.RecordSize)
+	}
+
+	treeSize := self.NodeCount * self.RecordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, ErrInvalidMMDB
+	}
+	self.data = buf[treeSize+16 : i]
+
+	if self.IPVersion == 6 {
+		for n := 0; n < 96 && self.ipv4Start < self.NodeCount; n++ {
+			self.ipv4Start = self.record(self.ipv4Start, 0)
+		}
+	}
+	return
+}
+
+// read the left(0) or right(1) record of the node
+func (self *MMDB) record(node uint, bit uint) uint {
+	switch self.RecordSize {
+	case 24:
+		b := self.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := self.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(self.buf[node*8+bit*4:]))
+	}
+}
+
+// Lookup the record of ip, returns nil if not found
+func (self *MMDB) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = self.ipv4Start
+	} else if self.IPVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < self.NodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = self.record(node, bit)
+	}
+	if node <= self.NodeCount {
+		return nil, nil
+	}
+	offset := node - self.NodeCount - 16
+	if offset >= uint(len(self.data)) {
+		return nil, ErrInvalidMMDB
+	}
+	v, _, err := (&mmdbDecoder{buf: self.data}).decode(offset)
+	return v, err
+}
+
+// ISO country code of ip, e.g. CN, empty if not found
+func (self *MMDB) Country(ip net.IP) string {
+	v, err := self.Lookup(ip)
+	if err != nil || v == nil {
+		return ""
+	}
+	for _, k := range []string{"country", "registered_country"} {
+		if code := mmdbPath(v, k, "iso_code"); code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+// autonomous system number of ip, 0 if not found
+func (self *MMDB) ASN(ip net.IP) uint {
+	v, err := self.Lookup(ip)
+	if err != nil || v == nil {
+		return 0
+	}
+	m, _ := v.(map[string]interface{})
+	n, _ := m["autonomous_system_number"].(uint64)
+	return uint(n)
+}
+
+// get string by the key path in record v
+func mmdbPath(v interface{}, keys ...string) string {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = m[k]
+	}
+	s, _ := v.(string)
+	return s
+}
+
+// decoder of the data section format
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// data types
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// decode value at offset, returns the value and the offset after it
+func (self *mmdbDecoder) decode(offset uint) (v interface{}, next uint, err error) {
+	return self.decodeDepth(offset, 0)
+}
+
+// decode value nested in depth maps and arrays, pointers are followed once
+func (self *mmdbDecoder) decodeDepth(offset uint, depth int) (v interface{}, next uint, err error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, ErrInvalidMMDB
+	}
+	typ, size, offset, err := self.control(offset)
+	if err != nil {
+		return
+	}
+	if typ == mmdbPointer {
+		var ptr uint
+		ptr, next, err = self.pointer(size, offset)
+		if err != nil {
+			return
+		}
+		// pointer to pointer is not allowed, so a pointer never loops itself
+		if typ, size, offset, err = self.control(ptr); err != nil {
+			return
+		}
+		if typ == mmdbPointer {
+			return nil, 0, ErrInvalidMMDB
+		}
+		v, _, err = self.value(typ, size, offset, depth)
+		return
+	}
+	return self.value(typ, size, offset, depth)
+}
+
+// read type and size from control byte(s)
+func (self *mmdbDecoder) control(offset uint) (typ, size, next uint, err error) {
+	if offset >= uint(len(self.buf)) {
+		return 0, 0, 0, ErrInvalidMMDB
+	}
+	ctrl := uint(self.buf[offset])
+	offset++
+	typ = ctrl >> 5
+	if typ == mmdbExtended {
+		if offset >= uint(len(self.buf)) {
+			return 0, 0, 0, ErrInvalidMMDB
+		}
+		typ = 7 + uint(self.buf[offset])
+		offset++
+	}
+	size = ctrl & 0x1f
+	if typ == mmdbPointer || size < 29 {
+		return typ, size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(self.buf)) {
+		return 0, 0, 0, ErrInvalidMMDB
+	}
+	b := self.buf[offset : offset+n]
+	switch n {
+	case 1:
+		size = 29 + uint(b[0])
+	case 2:
+		size = 285 + (uint(b[0])<<8 | uint(b[1]))
+	case 3:
+		size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+	}
+	return typ, size, offset + n, nil
+}
+
+// read pointer, size is the 5 bits in control byte
+func (self *mmdbDecoder) pointer(size, offset uint) (ptr, next uint, err error) {
+	n := (size>>3)&0x3 + 1
+	if offset+n > uint(len(self.buf)) {
+		return 0, 0, ErrInvalidMMDB
+	}
+	b := self.buf[offset : offset+n]
+	switch n {
+	case 1:
+		ptr = (size&0x7)<<8 | uint(b[0])
+	case 2:
+		ptr = ((size&0x7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 3:
+		ptr = ((size&0x7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	case 4:
+		ptr = uint(binary.BigEndian.Uint32(b))
+	}
+	return ptr, offset + n, nil
+}
+
+func (self *mmdbDecoder) value(typ, size, offset uint, depth int) (v interface{}, next uint, err error) {
+	// each element takes a byte at least, never allocate more than the data
+	hint := size
+	if rest := uint(len(self.buf)) - offset; hint > rest {
+		hint = rest
+	}
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, hint)
+		for i := uint(0); i < size; i++ {
+			var k, e interface{}
+			k, offset, err = self.decodeDepth(offset, depth+1)
+			if err != nil {
+				return
+			}
+			e, offset, err = self.decodeDepth(offset, depth+1)
+			if err != nil {
+				return
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, 0, ErrInvalidMMDB
+			}
+			m[ks] = e
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, hint)
+		for i := uint(0); i < size; i++ {
+			var e interface{}
+			e, offset, err = self.decodeDepth(offset, depth+1)
+			if err != nil {
+				return
+			}
+			a = append(a, e)
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(self.buf)) {
+		return nil, 0, ErrInvalidMMDB
+	}
+	b := self.buf[offset : offset+size]
+	next = offset + size
+	switch typ {
+	case mmdbString:
+		v = string(b)
+	case mmdbBytes, mmdbUint128:
+		v = append([]byte(nil), b...)
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, ErrInvalidMMDB
+		}
+		v = math.Float64frombits(binary.BigEndian.Uint64(b))
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, ErrInvalidMMDB
+		}
+		v = math.Float32frombits(binary.BigEndian.Uint32(b))
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		v = n
+	case mmdbInt32:
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		v = int32(n)
+	default:
+		return nil, 0, fmt.Errorf("unknown data type %d of MaxMind DB", typ)
+	}
+	return
+}
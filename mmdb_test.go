@@ -0,0 +1,232 @@
+package mallory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// MaxMind DB written by the spec, https://maxmind.github.io/MaxMind-DB/
+type testMMDB struct {
+	recordSize uint
+	ipVersion  uint
+	// records of nodes, left and right
+	nodes [][2]uint
+	// data offsets of the left and right records of nodes, if networks end
+	leaves map[uint]map[uint]uint
+	data   []byte
+}
+
+func newTestMMDB(recordSize, ipVersion uint) *testMMDB {
+	return &testMMDB{recordSize: recordSize, ipVersion: ipVersion, nodes: [][2]uint{{}},
+		leaves: make(map[uint]map[uint]uint)}
+}
+
+// insert the network of ip and prefix bits to the data at offset
+func (self *testMMDB) insert(ip net.IP, bits int, offset uint) {
+	if ip4 := ip.To4(); ip4 == nil {
+		ip = ip.To16()
+	} else if self.ipVersion == 4 {
+		ip = ip4
+	} else {
+		// IPv4 is in ::/96 of IPv6 trees
+		ip = append(make(net.IP, 12), ip4...)
+	}
+	node := uint(0)
+	for i := 0; i < bits; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		if i == bits-1 {
+			if self.leaves[node] == nil {
+				self.leaves[node] = make(map[uint]uint)
+			}
+			self.leaves[node][bit] = offset
+			return
+		}
+		next := self.nodes[node][bit]
+		if next == 0 {
+			next = uint(len(self.nodes))
+			self.nodes = append(self.nodes, [2]uint{})
+			self.nodes[node][bit] = next
+		}
+		node = next
+	}
+}
+
+func (self *testMMDB) bytes() []byte {
+	count := uint(len(self.nodes))
+	var buf bytes.Buffer
+	for node, children := range self.nodes {
+		var rec [2]uint
+		for bit := uint(0); bit < 2; bit++ {
+			if off, ok := self.leaves[uint(node)][bit]; ok {
+				rec[bit] = count + 16 + off
+			} else if children[bit] != 0 {
+				rec[bit] = children[bit]
+			} else {
+				rec[bit] = count
+			}
+		}
+		l, r := rec[0], rec[1]
+		switch self.recordSize {
+		case 24:
+			buf.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 28:
+			buf.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(l>>20)&0xF0 | byte(r>>24)&0x0F,
+				byte(r >> 16), byte(r >> 8), byte(r)})
+		case 32:
+			binary.Write(&buf, binary.BigEndian, [2]uint32{uint32(l), uint32(r)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(self.data)
+	buf.Write(mmdbMetadataStart)
+	buf.Write(testMap(
+		testStr("node_count"), testUint(mmdbUint32, uint64(count)),
+		testStr("record_size"), testUint(mmdbUint16, uint64(self.recordSize)),
+		testStr("ip_version"), testUint(mmdbUint16, uint64(self.ipVersion)),
+		testStr("database_type"), testStr("Test")))
+	return buf.Bytes()
+}
+
+// write the DB to a temp file and open it
+func (self *testMMDB) open(t *testing.T) (*MMDB, error) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, self.bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return OpenMMDB(path)
+}
+
+// control byte(s) of type and size less than 29
+func testCtrl(typ, size uint) []byte {
+	if typ > 7 {
+		return []byte{byte(size), byte(typ - 7)}
+	}
+	return []byte{byte(typ<<5 | size)}
+}
+
+func testStr(s string) []byte {
+	return append(testCtrl(mmdbString, uint(len(s))), s...)
+}
+
+func testUint(typ uint, n uint64) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append(testCtrl(typ, uint(len(b))), b...)
+}
+
+func testMap(kvs ...[]byte) []byte {
+	b := testCtrl(mmdbMap, uint(len(kvs)/2))
+	for _, kv := range kvs {
+		b = append(b, kv...)
+	}
+	return b
+}
+
+// pointer of 11 bits
+func testPtr(ptr uint) []byte {
+	return []byte{byte(mmdbPointer<<5 | ptr>>8&0x7), byte(ptr)}
+}
+
+func TestMMDBLookup(t *testing.T) {
+	for _, size := range []uint{24, 28, 32} {
+		for _, version := range []uint{4, 6} {
+			db := newTestMMDB(size, version)
+			// the country code is shared by pointers
+			au := uint(len(db.data))
+			db.data = append(db.data, testStr("AU")...)
+			country := uint(len(db.data))
+			db.data = append(db.data, testMap(testStr("country"), testMap(testStr("iso_code"), testPtr(au)))...)
+			registered := uint(len(db.data))
+			db.data = append(db.data, testMap(testStr("registered_country"), testMap(testStr("iso_code"), testPtr(au)))...)
+			asn := uint(len(db.data))
+			db.data = append(db.data, testMap(testStr("autonomous_system_number"), testUint(mmdbUint32, 13335))...)
+
+			db.insert(net.ParseIP("1.2.3.0"), int(version/6*96)+24, country)
+			db.insert(net.ParseIP("1.2.4.0"), int(version/6*96)+24, registered)
+			db.insert(net.ParseIP("10.0.0.0"), int(version/6*96)+8, asn)
+			if version == 6 {
+				db.insert(net.ParseIP("2001:db8::"), 32, country)
+			}
+			m, err := db.open(t)
+			if err != nil {
+				t.Fatalf("record size %d, IPv%d: %s", size, version, err)
+			}
+
+			for ip, want := range map[string]string{
+				"1.2.3.4": "AU", "1.2.4.255": "AU", "1.2.5.1": "", "8.8.8.8": "", "10.1.2.3": "",
+			} {
+				if got := m.Country(net.ParseIP(ip)); got != want {
+					t.Errorf("record size %d, IPv%d: country of %s is %q, want %q", size, version, ip, got, want)
+				}
+			}
+			if got := m.ASN(net.ParseIP("10.1.2.3")); got != 13335 {
+				t.Errorf("record size %d, IPv%d: ASN is %d, want 13335", size, version, got)
+			}
+			want := ""
+			if version == 6 {
+				want = "AU"
+			}
+			if got := m.Country(net.ParseIP("2001:db8::1")); got != want {
+				t.Errorf("record size %d, IPv%d: country of IPv6 is %q, want %q", size, version, got, want)
+			}
+		}
+	}
+}
+
+func TestMMDBInvalidData(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"pointer to itself":      testPtr(0),
+		"pointer to pointer":     append(testPtr(2), testPtr(0)...),
+		"pointer out of data":    testPtr(2000),
+		"pointer loop in map":    testMap(testStr("a"), testPtr(0)),
+		"string out of data":     append(testCtrl(mmdbString, 20), "abc"...),
+		"map larger than data":   {mmdbMap<<5 | 31, 0xff, 0xff, 0xff},
+		"map key is not string":  testMap(testUint(mmdbUint16, 1), testStr("a")),
+		"double of wrong size":   append(testCtrl(mmdbDouble, 4), 0, 0, 0, 0),
+		"truncated control byte": {0},
+	} {
+		db := newTestMMDB(24, 4)
+		db.data = data
+		db.insert(net.ParseIP("1.0.0.0"), 8, 0)
+		m, err := db.open(t)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if v, err := m.Lookup(net.ParseIP("1.1.1.1")); err == nil {
+			t.Errorf("%s: decoded %v, want error", name, v)
+		}
+		// never matched
+		if got := m.Country(net.ParseIP("1.1.1.1")); got != "" {
+			t.Errorf("%s: country is %q", name, got)
+		}
+	}
+}
+
+func TestOpenMMDBInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	os.WriteFile(path, []byte("not a MaxMind DB"), 0644)
+	if _, err := OpenMMDB(path); err != ErrInvalidMMDB {
+		t.Errorf("no metadata: %v", err)
+	}
+
+	db := newTestMMDB(20, 4)
+	if _, err := db.open(t); err == nil {
+		t.Errorf("record size 20 is accepted")
+	}
+
+	// tree larger than the file
+	db = newTestMMDB(24, 4)
+	buf := db.bytes()
+	i := bytes.LastIndex(buf, mmdbMetadataStart)
+	buf = append(buf[i:i:i], buf[i:]...)
+	os.WriteFile(path, buf, 0644)
+	if _, err := OpenMMDB(path); err != ErrInvalidMMDB {
+		t.Errorf("no tree: %v", err)
+	}
+}
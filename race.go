@@ -0,0 +1,134 @@
+package mallory
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// timeout of direct dial when racing with the remote
+	raceDialTimeout = 10 * time.Second
+	// host is treated as blocked after the remote wins so many races in a row
+	raceBlockedStreak = 3
+)
+
+// result of dial in the race
+type raceResult struct {
+	conn    net.Conn
+	proxied bool
+	err     error
+}
+
+// Dial addr both directly and through the default remote. The direct dial has
+// a head start, the remote one starts after it or once the direct one fails.
+// The first connected wins and the other one is closed. Hosts routed direct
+// by config never race.
+func (self *Server) race(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !Raced(ctx) {
+		return self.dialDirect(ctx, network, addr)
+	}
+	// the client over the quota of the remote never races
+	client, _ := ctx.Value(clientKey{}).(string)
+	if self.exceeded(client, self.Remote) != nil {
+		return self.dialDirect(ctx, network, addr)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	results := make(chan raceResult, 2)
+	go func() {
+		c, err := self.dialDirect(ctx, network, addr)
+		results <- raceResult{conn: c, err: err}
+	}()
+
+	pending, proxying := 1, false
+	startProxy := func() {
+		pending++
+		proxying = true
+		go func() {
+			c, err := self.Remote.Dial(network, addr)
+			if err == nil {
+				c = proxiedConn{c}
+			}
+			results <- raceResult{conn: c, proxied: true, err: err}
+		}()
+	}
+	// close the losers when they connected
+	drain := func(n int) {
+		go func() {
+			for ; n > 0; n-- {
+				if res := <-results; res.conn != nil {
+					res.conn.Close()
+				}
+			}
+		}()
+	}
+
+	timer := time.NewTimer(self.HeadStart)
+	defer timer.Stop()
+
+	var err error
+	for {
+		select {
+		case <-timer.C:
+			if !proxying {
+				startProxy()
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				drain(pending)
+				self.raceWon(addr, res.proxied, time.Since(start))
+				return res.conn, nil
+			}
+			L.Printf("RACE %s %s: %s\n", AccessType(res.proxied), addr, res.err)
+			if ctx.Err() == nil {
+				self.Stats.Failed(HostOnly(addr), res.proxied)
+			}
+			err = res.err
+			if !proxying {
+				startProxy()
+			} else if pending == 0 {
+				return nil, err
+			}
+		case <-ctx.Done():
+			drain(pending)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// feed the winner back to the stats, and cache host as blocked if the
+// remote always wins
+func (self *Server) raceWon(addr string, proxied bool, d time.Duration) {
+	host := HostOnly(addr)
+	hs := self.Stats.Won(host, proxied, d)
+	if proxied {
+		L.Printf("RACE %s won by %s in %s\n", addr, AccessType(proxied), BeautifyDuration(d))
+	}
+	if hs.ProxyStreak == raceBlockedStreak {
+		self.block(host, fmt.Errorf("%s won %d races in a row", AccessType(true), hs.ProxyStreak))
+	}
+}
+
+// connection won by the remote in race
+type proxiedConn struct {
+	net.Conn
+}
+
+func (self proxiedConn) CloseWrite() error {
+	if cw, ok := self.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Whether c is connected through the remote in race
+func Proxied(c net.Conn) bool {
+	_, ok := c.(proxiedConn)
+	return ok
+}
@@ -0,0 +1,34 @@
+package mallory
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRaceRoutedDirect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := newTestServer(t, "")
+	remote := &testRemote{}
+	srv.Remote = remote
+	srv.HeadStart = 0
+
+	for _, reason := range []string{"routes", "IP routes", "normal server"} {
+		c, err := srv.race(WithReason(context.Background(), reason), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: %s", reason, err)
+		}
+		if Proxied(c) {
+			t.Errorf("%s: connected through the remote", reason)
+		}
+		c.Close()
+	}
+	if n := atomic.LoadInt32(&remote.dials); n != 0 {
+		t.Errorf("remote dialed %d times for hosts routed direct", n)
+	}
+}
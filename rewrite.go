@@ -0,0 +1,153 @@
+package mallory
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// Rule to rewrite plain HTTP and intercepted HTTPS requests and responses
+type RewriteRule struct {
+	// host pattern to match, e.g. "api.corp.com" or "*.corp.com"
+	Host string `json:"host"`
+	// path pattern to match, e.g. "/v1/*", empty to match all
+	Path string `json:"path"`
+	// redirect the client to this URL, path and query of the request are kept
+	// if the URL has no path, e.g. "https://www.example.com"
+	Redirect string `json:"redirect"`
+	// status code of redirect, default is 302
+	RedirectCode int `json:"redirect_code"`
+	// replace the Host header sent to server, the connection is still made to
+	// the host in URL
+	RewriteHost string `json:"rewrite_host"`
+	// request headers to set, e.g. {"Authorization": "Bearer xxx"}
+	SetHeaders map[string]string `json:"set_headers"`
+	// request headers to remove, e.g. ["Referer", "X-Client-Data"]
+	DelHeaders []string `json:"del_headers"`
+	// response headers to set
+	SetResponseHeaders map[string]string `json:"set_response_headers"`
+	// response headers to remove
+	DelResponseHeaders []string `json:"del_response_headers"`
+	// parsed redirect URL
+	redirect *url.URL
+}
+
+// check the patterns and parse the redirect URL
+func (self *RewriteRule) init() (err error) {
+	if _, err = path.Match(self.Host, ""); err != nil {
+		return
+	}
+	if _, err = path.Match(self.Path, ""); err != nil {
+		return
+	}
+	if self.Redirect != "" {
+		self.redirect, err = url.Parse(self.Redirect)
+		if err != nil {
+			return
+		}
+	}
+	if self.RedirectCode == 0 {
+		self.RedirectCode = http.StatusFound
+	}
+	return
+}
+
+// test whether the rule applies to the request of host and path
+func (self *RewriteRule) Match(host, p string) bool {
+	if matched, _ := path.Match(self.Host, host); !matched {
+		return false
+	}
+	if self.Path == "" {
+		return true
+	}
+	matched, _ := path.Match(self.Path, p)
+	return matched
+}
+
+// Rewrite the request, returns the URL to redirect the client if not nil
+func (self *RewriteRule) Request(r *http.Request) *url.URL {
+	if self.redirect != nil {
+		u := *self.redirect
+		if u.Path == "" {
+			u.Path, u.RawPath, u.RawQuery = r.URL.Path, r.URL.RawPath, r.URL.RawQuery
+		}
+		return &u
+	}
+	if self.RewriteHost != "" {
+		r.Host = self.RewriteHost
+	}
+	for _, k := range self.DelHeaders {
+		r.Header.Del(k)
+	}
+	for k, v := range self.SetHeaders {
+		r.Header.Set(k, v)
+	}
+	return nil
+}
+
+// Rewrite the response header
+func (self *RewriteRule) Response(h http.Header) {
+	for _, k := range self.DelResponseHeaders {
+		h.Del(k)
+	}
+	for k, v := range self.SetResponseHeaders {
+		h.Set(k, v)
+	}
+}
+
+// Rewrite request r by rules in order, and the response header written to w.
+// Returns the writer to serve r, or nil if the client has been redirected.
+func Rewrite(rules []*RewriteRule, w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if len(rules) == 0 {
+		return w
+	}
+	for _, rule := range rules {
+		if u := rule.Request(r); u != nil {
+			L.Printf("REDIRECT %s to %s\n", r.URL, u)
+			http.Redirect(w, r, u.String(), rule.RedirectCode)
+			return nil
+		}
+	}
+	return &rewriteWriter{ResponseWriter: w, rules: rules}
+}
+
+// rewrite response header before written
+type rewriteWriter struct {
+	http.ResponseWriter
+	rules []*RewriteRule
+	wrote bool
+}
+
+func (self *rewriteWriter) WriteHeader(code int) {
+	// informational responses are followed by the final one
+	if !self.wrote && code >= 200 {
+		self.wrote = true
+		for _, rule := range self.rules {
+			rule.Response(self.Header())
+		}
+	}
+	self.ResponseWriter.WriteHeader(code)
+}
+
+func (self *rewriteWriter) Write(b []byte) (int, error) {
+	if !self.wrote {
+		self.WriteHeader(http.StatusOK)
+	}
+	return self.ResponseWriter.Write(b)
+}
+
+func (self *rewriteWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hij, ok := self.ResponseWriter.(http.Hijacker); ok {
+		return hij.Hijack()
+	}
+	return nil, nil, errors.New("Server does not support Hijacker")
+}
+
+func (self *rewriteWriter) Flush() {
+	if f, ok := self.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -2,8 +2,19 @@
 package mallory
 
 import (
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/tabwriter"
 	"time"
 
 	"golang.org/x/net/publicsuffix"
@@ -14,6 +25,32 @@ const (
 	NormalSrv
 )
 
+const (
+	// max hosts in blocked cache
+	blockedCacheSize = 4096
+	// time to live of hosts in blocked cache
+	blockedCacheTTL = time.Hour
+	// max hosts in the cache of IP routes
+	ipRouteCacheSize = 4096
+	// time to live of hosts in the cache of IP routes, as resolved IPs change
+	ipRouteCacheTTL = 10 * time.Minute
+	// max size of request body kept in memory to replay
+	replayBodyLimit = 64 * 1024
+	// race once in so many connections preferring proxy by stats
+	statsExplore = 10
+	// interval to save stats
+	statsSaveInterval = time.Minute
+)
+
+// reason of hosts not routed by config or stats, which race direct with the remote
+const defaultReason = "default"
+
+// Outbound names reserved in routes
+const (
+	DirectOutbound = "direct"
+	ProxyOutbound  = "proxy"
+)
+
 type AccessType bool
 
 func (t AccessType) String() string {
@@ -24,66 +61,320 @@ func (t AccessType) String() string {
 	}
 }
 
+// cached result of blocked test
+type blockedEntry struct {
+	blocked bool
+	reason  string
+}
+
+// cached IP route of host
+type ipRouteEntry struct {
+	name string
+	ok   bool
+}
+
 type Server struct {
 	// SmartSrv or NormalSrv
 	Mode int
 	// config file
 	Cfg *Config
-	// direct fetcher
+	// direct fetcher, races with the default remote
 	Direct *Direct
-	// ssh fetcher, to connect remote proxy server
-	SSH *SSH
-	// a cache
-	BlockedHosts map[string]bool
-	// for serve http
-	mutex sync.RWMutex
+	// head start of direct dial in the race
+	HeadStart time.Duration
+	// route statistics of hosts
+	Stats *Stats
+	// detect interference on direct connections
+	Detector *Detector
+	// default remote fetcher, to connect remote proxy server
+	Remote Remote
+	// named remote fetchers, selected by routes
+	Remotes map[string]Remote
+	// cache of HTTP responses, nil to disable
+	Cache *Cache
+	// cache of blocked and not blocked hosts
+	BlockedHosts *LRU
+	// cache of IP routes of resolved hosts
+	IPRoutes *LRU
+	// resolving hosts for IP routes
+	lookups Group
+	// limits of clients and hosts
+	Limiter *Limiter
+	// bytes of clients per day
+	Usage *Usage
+	// config generation of the cache
+	generation uint64
+	// dial without racing
+	dialDirect func(ctx context.Context, network, addr string) (net.Conn, error)
+	// hijacked connections to drain on shutdown
+	Tunnels *Tunnels
+	// listening servers, no more once shut down
+	servers  []*http.Server
+	shutdown bool
+	mutex    sync.Mutex
+	// file to save stats, empty if not saved
+	statsPath string
 }
 
-// Create and intialize
-func NewServer(mode int, c *Config) (self *Server, err error) {
-	ssh, err := NewSSH(c)
+// Create and intialize, limiter, shaper and usage are shared with other
+// servers of c
+func NewServer(mode int, c *Config, limiter *Limiter, shaper *Shaper, usage *Usage) (self *Server, err error) {
+	remote, err := NewRemote(c, c.File.RemoteServer, limiter, shaper, usage)
 	if err != nil {
 		return
 	}
 
+	remotes := make(map[string]Remote)
+	for name, rawurl := range c.File.Remotes {
+		remotes[name], err = NewRemote(c, rawurl, limiter, shaper, usage)
+		if err != nil {
+			return
+		}
+	}
+
 	shouldProxyTimeout := time.Millisecond * time.Duration(c.File.ShouldProxyTimeoutMS)
+	if shouldProxyTimeout == 0 {
+		shouldProxyTimeout = 200 * time.Millisecond
+	}
+	direct, err := NewDirect(raceDialTimeout, c.File.DirectProxy)
+	if err != nil {
+		return
+	}
 
 	self = &Server{
 		Mode:         mode,
 		Cfg:          c,
-		Direct:       NewDirect(shouldProxyTimeout),
-		SSH:          ssh,
-		BlockedHosts: make(map[string]bool),
+		Direct:       direct,
+		HeadStart:    shouldProxyTimeout,
+		Stats:        NewStats(),
+		Remote:       remote,
+		Remotes:      remotes,
+		BlockedHosts: NewLRU(blockedCacheSize, blockedCacheTTL),
+		IPRoutes:     NewLRU(ipRouteCacheSize, ipRouteCacheTTL),
+		Tunnels:      NewTunnels(),
+		Limiter:      limiter,
+		Usage:        usage,
+	}
+	self.Detector = &Detector{Cfg: c, OnBlocked: self.block}
+
+	dial := direct.Tr.DialContext
+	self.dialDirect = dial
+	if c.File.DirectProxy == "" {
+		// hosts are resolved by the upstream proxy otherwise
+		self.dialDirect = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return self.Detector.Dial(ctx, dial, network, addr)
+		}
+	}
+	// all direct connections race with the remote
+	direct.Tr.Dial = nil
+	direct.Tr.DialContext = self.race
+	direct.Detector = self.Detector
+	direct.Fallback = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// the client over the quota of the remote never falls back
+		client, _ := ctx.Value(clientKey{}).(string)
+		if qerr := self.exceeded(client, self.Remote); qerr != nil {
+			return nil, qerr
+		}
+		c, err := self.Remote.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return proxiedConn{c}, nil
+	}
+	direct.SetTimeouts(c.File.Timeouts())
+	direct.Shaper = shaper
+	direct.Usage = self.Usage
+	direct.Transferred = func(host string, conn net.Conn, n int64, d time.Duration) {
+		self.Stats.Transferred(HostOnly(host), Proxied(conn), n, d)
+	}
+
+	if c.File.CacheDir != "" {
+		self.Cache, err = OpenCache(os.ExpandEnv(c.File.CacheDir),
+			c.File.CacheSizeMB<<20, c.File.CacheObjectMB<<20)
+		if err != nil {
+			return
+		}
+	}
+
+	// only smart server makes decisions by stats
+	if mode == SmartSrv && c.File.StatsFile != "" {
+		self.statsPath = os.ExpandEnv(c.File.StatsFile)
+		if err = self.Stats.Load(self.statsPath); err != nil {
+			return
+		}
+		go func() {
+			for range time.Tick(statsSaveInterval) {
+				self.saveStats()
+			}
+		}()
 	}
 	return
 }
 
+func (self *Server) saveStats() {
+	if err := self.Stats.Save(self.statsPath); err != nil {
+		L.Printf("Save stats %s: %s\n", self.statsPath, err)
+	}
+}
+
+// cache host as blocked
+func (self *Server) block(host string, reason error) {
+	L.Printf("BLOCKED %s: %s\n", host, reason)
+	self.BlockedHosts.Set(host, blockedEntry{blocked: true, reason: reason.Error()})
+}
+
+// test whether host is blocked
 func (self *Server) Blocked(host string) bool {
-	blocked, cached := false, false
+	blocked, _ := self.blocked(host)
+	return blocked
+}
+
+// test whether host is blocked, with the reason
+func (self *Server) blocked(host string) (bool, string) {
 	host = HostOnly(host)
-	self.mutex.RLock()
-	if self.BlockedHosts[host] {
-		blocked = true
-		cached = true
+	self.refresh()
+	if v, ok := self.BlockedHosts.Get(host); ok {
+		e := v.(blockedEntry)
+		return e.blocked, e.reason
 	}
-	self.mutex.RUnlock()
 
-	if !blocked {
-		tld, _ := publicsuffix.EffectiveTLDPlusOne(host)
-		blocked = self.Cfg.Blocked(tld)
-	}
+	tld, _ := publicsuffix.EffectiveTLDPlusOne(host)
+	blocked := self.Cfg.Blocked(tld)
 
 	if !blocked {
 		suffix, _ := publicsuffix.PublicSuffix(host)
 		blocked = self.Cfg.Blocked(suffix)
 	}
 
-	if blocked && !cached {
-		self.mutex.Lock()
-		self.BlockedHosts[host] = true
-		self.mutex.Unlock()
+	e := blockedEntry{blocked: blocked}
+	if blocked {
+		e.reason = "blocked list"
 	}
-	return blocked
+	self.BlockedHosts.Set(host, e)
+	return e.blocked, e.reason
+}
+
+// the caches of hosts are outdated once config is reloaded
+func (self *Server) refresh() {
+	if gen := self.Cfg.Generation(); atomic.SwapUint64(&self.generation, gen) != gen {
+		self.BlockedHosts.Clear()
+		self.IPRoutes.Clear()
+	}
+}
+
+// Pick the outbound for host, returns the name for logging and the remote
+// fetcher to use, nil remote means to connect directly.
+// Host is resolved for the routes of destination IP in smart mode.
+func (self *Server) Route(host string) (name string, remote Remote) {
+	name, remote, _ = self.route(host, self.Mode == SmartSrv, true)
+	return
+}
+
+// Pick the outbound for host by name only, never resolve it
+func (self *Server) RouteName(host string) (name string, remote Remote) {
+	name, remote, _ = self.route(host, false, true)
+	return
+}
+
+// Explain why host is routed to the outbound. Host is never resolved, the
+// routes of its IPs are known only if cached, and hosts preferring proxy by
+// stats are explained so without racing sometimes.
+func (self *Server) Explain(host string) (name, reason string) {
+	name, _, reason = self.route(host, false, false)
+	return
+}
+
+// route of host, resolve it for the routes of IPs if resolve, and race the
+// hosts preferring proxy by stats sometimes if explore
+func (self *Server) route(host string, resolve, explore bool) (name string, remote Remote, reason string) {
+	if host == "" {
+		return AccessType(false).String(), nil, "no host"
+	}
+	host = HostOnly(host)
+	if name, ok := self.Cfg.Route(host); ok {
+		name, remote = self.outbound(host, name)
+		return name, remote, "routes"
+	}
+	if self.Mode == SmartSrv {
+		if blocked, why := self.blocked(host); blocked {
+			name, remote = self.outbound(host, ProxyOutbound)
+			return name, remote, why
+		}
+	}
+	if name, ok := self.routeIP(host, resolve); ok {
+		name, remote = self.outbound(host, name)
+		return name, remote, "IP routes"
+	}
+	if self.Mode == NormalSrv {
+		name, remote = self.outbound(host, ProxyOutbound)
+		return name, remote, "normal server"
+	}
+	if hs, ok := self.Stats.Get(host); ok {
+		// still race sometimes to know whether direct gets better
+		if proxy, why := hs.PreferProxy(); proxy && (!explore || rand.Intn(statsExplore) != 0) {
+			name, remote = self.outbound(host, ProxyOutbound)
+			return name, remote, why
+		}
+	}
+	name, remote = self.outbound(host, DirectOutbound)
+	return name, remote, defaultReason
+}
+
+// match routes by the IP of host, resolve it if host is not an IP and not
+// cached, the result is cached even if it fails
+func (self *Server) routeIP(host string, resolve bool) (name string, ok bool) {
+	if !self.Cfg.IPRouted() {
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return self.Cfg.RouteIP(ip)
+	}
+	self.refresh()
+	if v, found := self.IPRoutes.Get(host); found {
+		e := v.(ipRouteEntry)
+		return e.name, e.ok
+	}
+	if !resolve {
+		return
+	}
+	v, _ := self.lookups.Do(host, func() (interface{}, error) {
+		return self.resolveRoute(host), nil
+	})
+	e := v.(ipRouteEntry)
+	return e.name, e.ok
+}
+
+// resolve host and match routes by its IPs, the result is cached
+func (self *Server) resolveRoute(host string) (e ipRouteEntry) {
+	defer func() { self.IPRoutes.Set(host, e) }()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		L.Printf("Lookup %s: %s\n", host, err)
+		return
+	}
+	for _, addr := range addrs {
+		if e.name, e.ok = self.Cfg.RouteIP(addr.IP); e.ok {
+			return
+		}
+	}
+	return
+}
+
+// get the remote fetcher by name
+func (self *Server) outbound(host, name string) (string, Remote) {
+	switch name {
+	case DirectOutbound:
+		return AccessType(false).String(), nil
+	case ProxyOutbound:
+		return AccessType(true).String(), self.Remote
+	}
+	if remote := self.Remotes[name]; remote != nil {
+		return name, remote
+	}
+	L.Printf("remote %s for %s not found, use default\n", name, host)
+	return AccessType(true).String(), self.Remote
 }
 
 // ServeHTTP proxy accepts requests with following two types:
@@ -110,35 +401,278 @@ func (self *Server) Blocked(host string) bool {
 //    to the remote server and copy the reponse to client.
 //
 func (self *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	use := (self.Blocked(r.URL.Host) || self.Mode == NormalSrv) && r.URL.Host != ""
-	L.Printf("[%s] %s %s %s\n", AccessType(use), r.Method, r.RequestURI, r.Proto)
+	if r.ProtoMajor == 2 {
+		r = absolute(r)
+	}
+	r = r.WithContext(WithTunnels(r.Context(), self.Tunnels))
+	name, remote, reason := self.route(r.URL.Host, self.Mode == SmartSrv, true)
+	// keyed by the user only if verified, or clients dodge limits by new names
+	client := ClientOf(r)
+	if user, ok := self.Cfg.User(r); ok {
+		client = user
+	}
+	qerr := self.exceeded(client, remote)
+	if qerr != nil && self.Cfg.Quota(client).Direct {
+		L.Printf("QUOTA %s: %s, connect directly\n", r.URL.Host, qerr)
+		name, remote, qerr = AccessType(false).String(), nil, nil
+	}
+	L.Printf("[%s] %s %s %s\n", name, r.Method, r.RequestURI, r.Proto)
+	r = r.WithContext(WithClient(WithReason(WithRoute(r.Context(), name), reason), client))
+	if qerr != nil {
+		L.Printf("QUOTA %s: %s\n", r.URL.Host, qerr)
+		Fail(w, r, qerr)
+		return
+	}
+
+	if r.Method == "CONNECT" || r.URL.IsAbs() {
+		release := self.limit(w, r)
+		if release == nil {
+			return
+		}
+		defer release()
+	}
 
 	if r.Method == "CONNECT" {
-		if use {
-			self.SSH.Connect(w, r)
+		if self.Cfg.Intercepted(HostOnly(r.URL.Host)) {
+			self.intercept(w, r)
+		} else if remote != nil {
+			remote.Connect(w, r)
 		} else {
 			err := self.Direct.Connect(w, r)
 			if err == ErrShouldProxy {
-				self.SSH.Connect(w, r)
+				if qerr := self.exceeded(client, self.Remote); qerr != nil {
+					Fail(w, r, qerr)
+					return
+				}
+				self.Remote.Connect(w, r.WithContext(WithRoute(r.Context(), AccessType(true).String())))
 			}
 		}
 	} else if r.URL.IsAbs() {
 		// This is an error if is not empty on Client
 		r.RequestURI = ""
+		// keep the upgrade request, e.g. WebSocket, the connection is
+		// hijacked once switched
+		upgrade := UpgradeType(r.Header)
 		RemoveHopHeaders(r.Header)
-		if use {
-			self.SSH.ServeHTTP(w, r)
+		if upgrade != "" {
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", upgrade)
+		}
+		if self.Cfg.Forwarded() {
+			AddForwarded(r)
+		}
+		// the default User-Agent of Go is not the client's
+		if _, ok := r.Header["User-Agent"]; !ok {
+			r.Header.Set("User-Agent", "")
+		}
+		if w = Rewrite(self.Cfg.Rewrites(HostOnly(r.URL.Host), r.URL.Path), w, r); w == nil {
+			// the client has been redirected
+			return
+		}
+		fetch := func(w http.ResponseWriter, r *http.Request) error {
+			return self.fetch(w, r, remote)
+		}
+		if self.Cache != nil && upgrade == "" {
+			self.Cache.ServeHTTP(w, r, fetch)
 		} else {
-			err := self.Direct.ServeHTTP(w, r)
-			if err == ErrShouldProxy {
-				self.SSH.ServeHTTP(w, r)
-			}
+			fetch(w, r)
 		}
 	} else if r.URL.Path == "/reload" {
 		self.reload(w, r)
+	} else if r.URL.Path == "/stats" {
+		self.stats(w, r)
+	} else if r.URL.Path == "/usage" {
+		self.usage(w, r)
 	} else {
-		L.Printf("%s is not a full URL path\n", r.RequestURI)
+		err := fmt.Errorf("%s is not a full URL path", r.RequestURI)
+		L.Println(err)
+		ErrorPage(w, r, http.StatusBadRequest, "http_request_error", err)
+	}
+}
+
+// check the request rates and tunnels of the client and host, returns the
+// func to call once done, or nil if the client has been replied with error
+func (self *Server) limit(w http.ResponseWriter, r *http.Request) func() {
+	client, host := ClientOf(r), HostOnly(r.URL.Host)
+	release := func() {}
+	err := self.Limiter.Request(client, host)
+	if err == nil && (r.Method == "CONNECT" || UpgradeType(r.Header) != "") {
+		release, err = self.Limiter.Tunnel(client, host)
+	}
+	if err != nil {
+		L.Printf("LIMIT %s %s: %s\n", r.Method, r.URL.Host, err)
+		Fail(w, r, err)
+		return nil
+	}
+	return release
+}
+
+// check the monthly quota of client through remote if it's SSH, returns the
+// error if exceeded
+func (self *Server) exceeded(client string, remote Remote) *LimitError {
+	if _, ok := remote.(*SSH); !ok {
+		return nil
 	}
+	q := self.Cfg.Quota(client)
+	if q.Bytes <= 0 {
+		return nil
+	}
+	now := time.Now()
+	if used := self.sshUsage(client, now.Format(usageMonthLayout)); used < q.Bytes {
+		return nil
+	}
+	next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+	return &LimitError{http.StatusTooManyRequests,
+		fmt.Sprintf("client %s exceeds monthly quota %s through SSH", client, BeautifySize(q.Bytes)),
+		next.Sub(now)}
+}
+
+// bytes of client through SSH remotes in days with the prefix
+func (self *Server) sshUsage(client, prefix string) (n int64) {
+	for name, bytes := range self.Usage.Get(client, prefix).Routes {
+		remote := self.Remotes[name]
+		if name == AccessType(true).String() {
+			remote = self.Remote
+		}
+		if _, ok := remote.(*SSH); ok {
+			n += bytes
+		}
+	}
+	return
+}
+
+// fetch the plain HTTP request through remote, or directly if nil
+func (self *Server) fetch(w http.ResponseWriter, r *http.Request, remote Remote) error {
+	if remote != nil {
+		return remote.ServeHTTP(w, r)
+	}
+	// keep small body to replay through remote
+	BufferBody(r, replayBodyLimit)
+	err := self.Direct.ServeHTTP(w, r)
+	if err == ErrShouldProxy {
+		if qerr := self.exceeded(ClientOf(r), self.Remote); qerr != nil {
+			Fail(w, r, qerr)
+			return qerr
+		}
+		if r.GetBody != nil {
+			r.Body, _ = r.GetBody()
+		}
+		err = self.Remote.ServeHTTP(w, r.WithContext(WithRoute(r.Context(), AccessType(true).String())))
+	}
+	return err
+}
+
+// HTTP/2 requests have no absolute URL, the host is in :authority.
+// Extended CONNECT is translated to the upgrade request, RFC 8441.
+func absolute(r *http.Request) *http.Request {
+	protocol := r.Header.Get(":protocol")
+	if r.URL.IsAbs() || r.Method == "CONNECT" && protocol == "" || local(r) {
+		return r
+	}
+	r.URL.Scheme = "http"
+	r.URL.Host = r.Host
+	if protocol != "" {
+		// only the secure WebSocket is allowed by browsers
+		if _, port, _ := net.SplitHostPort(r.Host); port != "80" {
+			r.URL.Scheme = "https"
+		}
+		r = r.WithContext(WithStreamBody(r.Context(), r.Body))
+		r.Method = "GET"
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		r.Header.Del(":protocol")
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", protocol)
+		if strings.EqualFold(protocol, "websocket") {
+			key := make([]byte, 16)
+			crand.Read(key)
+			r.Header.Set("Sec-Websocket-Key", base64.StdEncoding.EncodeToString(key))
+		}
+	}
+	r.RequestURI = r.URL.String()
+	return r
+}
+
+// whether the request is sent to the proxy itself, e.g. /reload
+func local(r *http.Request) bool {
+	laddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	lhost, lport, _ := net.SplitHostPort(laddr.String())
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil || port != lport {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && (ip.IsLoopback() || ip.Equal(net.ParseIP(lhost)))
+}
+
+// Listen on addr and serve, HTTPS with HTTP/2 if the certificate is given
+// in config, or HTTP/1.1 and h2c otherwise
+func (self *Server) ListenAndServe(addr string) error {
+	ln, err := Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return self.Serve(ln)
+}
+
+// Serve on the listener ln, which is closed once returned
+func (self *Server) Serve(ln net.Listener) error {
+	t := self.Cfg.File.Timeouts()
+	srv := &http.Server{Handler: self, ReadHeaderTimeout: t.Header, IdleTimeout: t.Idle}
+	self.mutex.Lock()
+	if self.shutdown {
+		self.mutex.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	}
+	self.servers = append(self.servers, srv)
+	self.mutex.Unlock()
+
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	if cert, key := self.Cfg.File.LocalCert, self.Cfg.File.LocalKey; cert != "" {
+		srv.Protocols.SetHTTP2(true)
+		return srv.ServeTLS(ln, cert, key)
+	}
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	return srv.Serve(ln)
+}
+
+// Shutdown stops listening, and waits active requests and tunnels to be done
+// until ctx is done, then closes the rest. Remote connections are closed and
+// stats are saved at last. Returns the error of ctx if not all drained.
+func (self *Server) Shutdown(ctx context.Context) (err error) {
+	self.mutex.Lock()
+	self.shutdown = true
+	servers := self.servers
+	self.mutex.Unlock()
+
+	L.Printf("Draining %d active tunnels...\n", self.Tunnels.Len())
+	for _, srv := range servers {
+		if e := srv.Shutdown(ctx); e != nil {
+			srv.Close()
+			err = e
+		}
+	}
+	if e := self.Tunnels.Drain(ctx); e != nil {
+		err = e
+	}
+
+	self.Direct.Tr.CloseIdleConnections()
+	self.Remote.Close()
+	for _, remote := range self.Remotes {
+		remote.Close()
+	}
+	if self.statsPath != "" {
+		self.saveStats()
+	}
+	if e := self.Usage.Save(); e != nil {
+		L.Printf("Save usage: %s\n", e)
+	}
+	return
 }
 
 func (self *Server) reload(w http.ResponseWriter, r *http.Request) {
@@ -151,3 +685,81 @@ func (self *Server) reload(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(self.Cfg.Path + " reloaded"))
 	}
 }
+
+// print the route and stats of hosts, or the given host in query
+func (self *Server) stats(w http.ResponseWriter, r *http.Request) {
+	hosts := self.Stats.Names()
+	if host := r.URL.Query().Get("host"); host != "" {
+		hosts = []string{host}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "HOST\tROUTE\tREASON\tSTATS\n")
+	for _, host := range hosts {
+		name, reason := self.Explain(host)
+		hs, _ := self.Stats.Get(host)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", host, name, reason, hs)
+	}
+	tw.Flush()
+}
+
+// print bytes of clients today and this month, or the given client in query
+func (self *Server) usage(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	day, month := now.Format(usageDayLayout), now.Format(usageMonthLayout)
+	clients := self.Usage.Clients(month)
+	if client := r.URL.Query().Get("client"); client != "" {
+		clients = []string{client}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "CLIENT\tTODAY\tMONTH\tSSH\tQUOTA\n")
+	for _, client := range clients {
+		today, total := self.Usage.Get(client, day), self.Usage.Get(client, month)
+		quota := "-"
+		if q := self.Cfg.Quota(client); q.Bytes > 0 {
+			quota = BeautifySize(q.Bytes)
+		}
+		fmt.Fprintf(tw, "%s\t->%s <-%s\t->%s <-%s\t%s\t%s\n", client,
+			BeautifySize(today.Sent), BeautifySize(today.Received),
+			BeautifySize(total.Sent), BeautifySize(total.Received),
+			BeautifySize(self.sshUsage(client, month)), quota)
+	}
+	tw.Flush()
+}
+
+// Terminate TLS of CONNECT with certificate signed by local CA, and serve the
+// decrypted requests as the plain HTTP ones
+func (self *Server) intercept(w http.ResponseWriter, r *http.Request) {
+	mitm := self.Cfg.MITM()
+	if mitm == nil {
+		err := errors.New("no CA to intercept HTTPS")
+		L.Printf("MITM: %s\n", err)
+		ErrorPage(w, r, http.StatusInternalServerError, "proxy_configuration_error", err)
+		return
+	}
+
+	t := Track(r)
+	defer t.Done()
+	conn, err := Tunnel(w, r)
+	if err != nil {
+		L.Printf("Tunnel: %s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	t.Add(conn)
+
+	host := r.URL.Host
+	// the decrypted requests are of the client of CONNECT
+	client := ClientOf(r)
+	err = mitm.Serve(conn, host, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Scheme = "https"
+		r.URL.Host = host
+		r.RequestURI = r.URL.String()
+		self.ServeHTTP(w, r.WithContext(WithClient(r.Context(), client)))
+	}))
+	if err != nil {
+		L.Printf("MITM %s: %s\n", host, err)
+	}
+}
@@ -0,0 +1,159 @@
+package mallory
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// max debt of a bucket in seconds, taken by interactive traffic
+	shapeMaxDebt = 5
+	// bytes read at least each time, to not wake up too often
+	shapeMinChunk = 1024
+)
+
+// Bandwidth limits in bytes per second, zero for unlimited
+type Bandwidth struct {
+	// all traffic
+	Global float64
+	// traffic of each outbound, by the route name, e.g. DIRECT, PROXY or a remote
+	Outbounds map[string]float64
+	// traffic of each client
+	Client float64
+}
+
+// take n bytes from the bucket b, up to one second of rate is kept, returns
+// the time to wait
+func takeBytes(b *bucket, n int, rate float64, now time.Time) time.Duration {
+	b.refill(rate, rate, now)
+	b.tokens -= float64(n)
+	if b.tokens < -rate*shapeMaxDebt {
+		b.tokens = -rate * shapeMaxDebt
+	}
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// Shaper limits bandwidth globally, per outbound and per client. Interactive
+// traffic is never delayed, but counted in the limits, so the bulk one slows
+// down to make room. Limits are read from config each time.
+type Shaper struct {
+	Cfg       *Config
+	global    bucket
+	outbounds buckets
+	clients   buckets
+	mutex     sync.Mutex
+}
+
+// Create shaper of the bandwidth in c
+func NewShaper(c *Config) *Shaper {
+	return &Shaper{Cfg: c}
+}
+
+// take n bytes of client through outbound, returns the time to wait
+func (self *Shaper) take(n int, bw Bandwidth, client, outbound string) (d time.Duration) {
+	now := time.Now()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	max := func(t time.Duration) {
+		if t > d {
+			d = t
+		}
+	}
+	if bw.Global > 0 {
+		max(takeBytes(&self.global, n, bw.Global, now))
+	}
+	if rate := bw.Outbounds[outbound]; rate > 0 {
+		max(takeBytes(self.outbounds.get(outbound, now), n, rate, now))
+	}
+	if bw.Client > 0 {
+		max(takeBytes(self.clients.get(client, now), n, bw.Client, now))
+	}
+	return
+}
+
+// Shaping returns the limits of traffic of client to host through outbound,
+// nil if there is no limit
+func (self *Shaper) Shaping(client, outbound, host string) *Shaping {
+	bw := self.Cfg.Bandwidth()
+	rate := bw.Global
+	if o := bw.Outbounds[outbound]; o > 0 && (rate == 0 || o < rate) {
+		rate = o
+	}
+	if bw.Client > 0 && (rate == 0 || bw.Client < rate) {
+		rate = bw.Client
+	}
+	if rate == 0 {
+		return nil
+	}
+	// wake up about 10 times per second at the lowest rate
+	chunk := int(rate / 10)
+	if chunk < shapeMinChunk {
+		chunk = shapeMinChunk
+	}
+	return &Shaping{
+		shaper:      self,
+		bw:          bw,
+		client:      client,
+		outbound:    outbound,
+		Chunk:       chunk,
+		interactive: self.Cfg.Interactive(HostOnly(host)),
+	}
+}
+
+// Shaping of traffic, nil for unlimited
+type Shaping struct {
+	// bytes to transfer between waits
+	Chunk       int
+	shaper      *Shaper
+	bw          Bandwidth
+	client      string
+	outbound    string
+	interactive bool
+}
+
+// Wait until n bytes transferred are allowed, never for interactive traffic
+func (self *Shaping) Wait(n int) {
+	if self == nil || n <= 0 {
+		return
+	}
+	d := self.shaper.take(n, self.bw, self.client, self.outbound)
+	if d > 0 && !self.interactive {
+		time.Sleep(d)
+	}
+}
+
+// Reader returns r shaped, or r as is if nil
+func (self *Shaping) Reader(r io.Reader) io.Reader {
+	if self == nil {
+		return r
+	}
+	return &shapedReader{r: r, shaping: self}
+}
+
+type shapedReader struct {
+	r       io.Reader
+	shaping *Shaping
+}
+
+func (self *shapedReader) Read(b []byte) (int, error) {
+	if len(b) > self.shaping.Chunk {
+		b = b[:self.shaping.Chunk]
+	}
+	n, err := self.r.Read(b)
+	self.shaping.Wait(n)
+	return n, err
+}
+
+// outbound name of the route, the race may be won by proxy
+func outboundOf(route string, proxied bool) string {
+	if proxied && strings.EqualFold(route, AccessType(false).String()) {
+		return AccessType(true).String()
+	}
+	return route
+}
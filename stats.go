@@ -0,0 +1,213 @@
+package mallory
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// max hosts in stats, the least recently updated ones are dropped
+	statsMaxHosts = 10000
+	// hosts kept when trimmed, not to sort them for every new host
+	statsTrimHosts = statsMaxHosts * 9 / 10
+	// connections needed before preferring a route
+	statsMinSamples = 5
+	// transfer smaller than this is too short to measure speed
+	statsMinTransfer = 64 * 1024
+	// weight of the new sample in averages
+	statsWeight = 0.2
+)
+
+// Route statistics of a host
+type HostStats struct {
+	// successful and failed direct connections
+	DirectOK   int `json:"direct_ok"`
+	DirectFail int `json:"direct_fail"`
+	// successful and failed remote connections
+	ProxyOK   int `json:"proxy_ok"`
+	ProxyFail int `json:"proxy_fail"`
+	// consecutive races won by remote connection
+	ProxyStreak int `json:"proxy_streak"`
+	// average time to connect
+	DirectLatency time.Duration `json:"direct_latency"`
+	ProxyLatency  time.Duration `json:"proxy_latency"`
+	// average bytes per second received from host
+	DirectSpeed float64 `json:"direct_speed"`
+	ProxySpeed  float64 `json:"proxy_speed"`
+	// last updated time
+	Updated time.Time `json:"updated"`
+}
+
+// success rate of direct connections
+func (self HostStats) DirectRate() float64 {
+	if n := self.DirectOK + self.DirectFail; n > 0 {
+		return float64(self.DirectOK) / float64(n)
+	}
+	return 1
+}
+
+// Whether the remote works better for host and why
+func (self HostStats) PreferProxy() (bool, string) {
+	if self.DirectOK+self.DirectFail >= statsMinSamples && self.DirectRate() < 0.5 {
+		return true, fmt.Sprintf("direct success rate %.0f%%", self.DirectRate()*100)
+	}
+	if self.DirectOK >= statsMinSamples && self.ProxyOK >= statsMinSamples &&
+		self.DirectSpeed > 0 && self.ProxySpeed > 2*self.DirectSpeed {
+		return true, fmt.Sprintf("proxy speed %s/s > direct speed %s/s",
+			BeautifySize(int64(self.ProxySpeed)), BeautifySize(int64(self.DirectSpeed)))
+	}
+	return false, ""
+}
+
+func (self HostStats) String() string {
+	return fmt.Sprintf("direct %d/%d %s %s/s, proxy %d/%d %s %s/s",
+		self.DirectOK, self.DirectOK+self.DirectFail, BeautifyDuration(self.DirectLatency),
+		BeautifySize(int64(self.DirectSpeed)),
+		self.ProxyOK, self.ProxyOK+self.ProxyFail, BeautifyDuration(self.ProxyLatency),
+		BeautifySize(int64(self.ProxySpeed)))
+}
+
+// moving average
+func average(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg*(1-statsWeight) + sample*statsWeight
+}
+
+// Route statistics of all hosts
+type Stats struct {
+	Hosts map[string]*HostStats
+	mutex sync.RWMutex
+}
+
+// Create and initialize
+func NewStats() *Stats {
+	return &Stats{Hosts: make(map[string]*HostStats)}
+}
+
+// update stats of host with f
+func (self *Stats) update(host string, f func(hs *HostStats)) HostStats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	hs := self.Hosts[host]
+	if hs == nil {
+		if len(self.Hosts) >= statsMaxHosts {
+			self.trim(statsTrimHosts)
+		}
+		hs = &HostStats{}
+		self.Hosts[host] = hs
+	}
+	f(hs)
+	hs.Updated = time.Now()
+	return *hs
+}
+
+// Record host is connected, returns the stats after updated
+func (self *Stats) Won(host string, proxied bool, latency time.Duration) HostStats {
+	return self.update(host, func(hs *HostStats) {
+		if proxied {
+			hs.ProxyOK++
+			hs.ProxyStreak++
+			hs.ProxyLatency = time.Duration(average(float64(hs.ProxyLatency), float64(latency)))
+		} else {
+			hs.DirectOK++
+			hs.ProxyStreak = 0
+			hs.DirectLatency = time.Duration(average(float64(hs.DirectLatency), float64(latency)))
+		}
+	})
+}
+
+// Record host is failed to connect
+func (self *Stats) Failed(host string, proxied bool) HostStats {
+	return self.update(host, func(hs *HostStats) {
+		if proxied {
+			hs.ProxyFail++
+		} else {
+			hs.DirectFail++
+		}
+	})
+}
+
+// Record n bytes received from host in d
+func (self *Stats) Transferred(host string, proxied bool, n int64, d time.Duration) {
+	if n < statsMinTransfer || d <= 0 {
+		return
+	}
+	speed := float64(n) / d.Seconds()
+	self.update(host, func(hs *HostStats) {
+		if proxied {
+			hs.ProxySpeed = average(hs.ProxySpeed, speed)
+		} else {
+			hs.DirectSpeed = average(hs.DirectSpeed, speed)
+		}
+	})
+}
+
+// Get stats of host, ok is false if not recorded
+func (self *Stats) Get(host string) (hs HostStats, ok bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if p := self.Hosts[host]; p != nil {
+		return *p, true
+	}
+	return
+}
+
+// Sorted hosts in stats
+func (self *Stats) Names() []string {
+	self.mutex.RLock()
+	names := make([]string, 0, len(self.Hosts))
+	for host := range self.Hosts {
+		names = append(names, host)
+	}
+	self.mutex.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Load stats from file, it's fine if the file does not exist
+func (self *Stats) Load(path string) error {
+	hosts := make(map[string]*HostStats)
+	if err := loadJSON(path, &hosts); err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	self.Hosts = hosts
+	if len(self.Hosts) > statsMaxHosts {
+		self.trim(statsMaxHosts)
+	}
+	self.mutex.Unlock()
+	return nil
+}
+
+// drop the least recently updated hosts to keep n, must be locked
+func (self *Stats) trim(n int) {
+	if n = len(self.Hosts) - n; n <= 0 {
+		return
+	}
+	hosts := make([]string, 0, len(self.Hosts))
+	for host := range self.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return self.Hosts[hosts[i]].Updated.Before(self.Hosts[hosts[j]].Updated)
+	})
+	for _, host := range hosts[:n] {
+		delete(self.Hosts, host)
+	}
+}
+
+// Save stats to file
+func (self *Stats) Save(path string) error {
+	self.mutex.RLock()
+	buf, err := json.MarshalIndent(self.Hosts, "", "  ")
+	self.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return saveFile(path, buf)
+}
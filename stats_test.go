@@ -0,0 +1,59 @@
+package mallory
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatsMaxHosts(t *testing.T) {
+	s := NewStats()
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < statsMaxHosts; i++ {
+		s.Hosts[fmt.Sprintf("host%d.example", i)] = &HostStats{Updated: start.Add(time.Duration(i) * time.Millisecond)}
+	}
+	// updating a known host never drops any
+	s.Won("host0.example", false, time.Millisecond)
+	if n := len(s.Hosts); n != statsMaxHosts {
+		t.Fatalf("%d hosts after updated, want %d", n, statsMaxHosts)
+	}
+
+	s.Won("new.example", false, time.Millisecond)
+	if n := len(s.Hosts); n > statsMaxHosts {
+		t.Errorf("%d hosts over the max %d", n, statsMaxHosts)
+	}
+	for _, host := range []string{"new.example", "host0.example", fmt.Sprintf("host%d.example", statsMaxHosts-1)} {
+		if _, ok := s.Get(host); !ok {
+			t.Errorf("recently updated %s is dropped", host)
+		}
+	}
+	if _, ok := s.Get("host1.example"); ok {
+		t.Errorf("least recently updated host is kept")
+	}
+}
+
+func TestStatsSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	s := NewStats()
+	// it's fine if the file does not exist
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	s.Won("a.example", true, time.Second)
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file is left: %v", err)
+	}
+
+	loaded := NewStats()
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if hs, ok := loaded.Get("a.example"); !ok || hs.ProxyOK != 1 || hs.ProxyLatency != time.Second {
+		t.Errorf("loaded %+v, %v", hs, ok)
+	}
+}
@@ -0,0 +1,111 @@
+package mallory
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoDeadline = errors.New("deadline not supported")
+)
+
+// context key of the stream body of extended CONNECT
+type streamBodyKey struct{}
+
+// Tunnel returns the client connection of the CONNECT request and replies 200.
+// The connection is hijacked for HTTP/1.1, or the stream of the request is
+// used as the connection for HTTP/2.
+func Tunnel(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.ProtoMajor == 2 {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return nil, errors.New("Server does not support Flusher")
+		}
+		body := r.Body
+		if b, ok := r.Context().Value(streamBodyKey{}).(io.ReadCloser); ok {
+			body = b
+		}
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		return &streamConn{body: body, w: w, flusher: flusher, addr: r.RemoteAddr}, nil
+	}
+
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("Server does not support Hijacker")
+	}
+	conn, _, err := hij.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Once connected successfully, return OK
+	conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	return conn, nil
+}
+
+// WithStreamBody returns the context to use body as the stream of the tunnel,
+// for the request sent upstream without body, e.g. extended CONNECT
+func WithStreamBody(ctx context.Context, body io.ReadCloser) context.Context {
+	return context.WithValue(ctx, streamBodyKey{}, body)
+}
+
+// net.Conn over the stream of HTTP/2 request, body to read and response to write
+type streamConn struct {
+	body    io.ReadCloser
+	w       io.Writer
+	flusher http.Flusher
+	addr    string
+	mutex   sync.Mutex
+	closed  bool
+}
+
+func (self *streamConn) Read(b []byte) (int, error) {
+	return self.body.Read(b)
+}
+
+func (self *streamConn) Write(b []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := self.w.Write(b)
+	if err == nil {
+		self.flusher.Flush()
+	}
+	return n, err
+}
+
+// the stream is ended once the handler returns, only stop reading and writing
+func (self *streamConn) Close() error {
+	self.mutex.Lock()
+	self.closed = true
+	self.mutex.Unlock()
+	return self.body.Close()
+}
+
+func (self *streamConn) LocalAddr() net.Addr {
+	return dummyAddr("stream")
+}
+
+func (self *streamConn) RemoteAddr() net.Addr {
+	return dummyAddr(self.addr)
+}
+
+// reading the stream can not be resumed after deadline
+func (self *streamConn) SetDeadline(t time.Time) error {
+	return ErrNoDeadline
+}
+
+func (self *streamConn) SetReadDeadline(t time.Time) error {
+	return ErrNoDeadline
+}
+
+func (self *streamConn) SetWriteDeadline(t time.Time) error {
+	return ErrNoDeadline
+}
@@ -0,0 +1,137 @@
+package mallory
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Timeouts of each stage of proxied connections, zero to disable
+type Timeouts struct {
+	// TLS handshake with servers, and connecting the remote server
+	Handshake time.Duration
+	// request header from clients, and response header from servers
+	Header time.Duration
+	// no data in either direction of tunnels and responses
+	Idle time.Duration
+	// total time of a request or tunnel
+	Lifetime time.Duration
+}
+
+// close the connection once idle or lived too long
+type watchdog struct {
+	idle time.Duration
+	// unix nano of the last activity
+	last     int64
+	timer    *time.Timer
+	lifetime *time.Timer
+	close    func(reason string)
+	once     sync.Once
+}
+
+// watch the connection, close is called once with the reason of timeout
+func newWatchdog(idle, lifetime time.Duration, close func(reason string)) *watchdog {
+	self := &watchdog{idle: idle, last: time.Now().UnixNano()}
+	self.close = func(reason string) {
+		self.once.Do(func() { close(reason) })
+	}
+	if idle > 0 {
+		self.timer = time.AfterFunc(idle, self.check)
+	}
+	if lifetime > 0 {
+		self.lifetime = time.AfterFunc(lifetime, func() {
+			self.close(fmt.Sprintf("lifetime %s exceeded", lifetime))
+		})
+	}
+	return self
+}
+
+// the timer is not reset on each activity, but re-armed for the rest of idle
+func (self *watchdog) check() {
+	d := time.Since(time.Unix(0, atomic.LoadInt64(&self.last)))
+	if d < self.idle {
+		self.timer.Reset(self.idle - d)
+		return
+	}
+	self.close(fmt.Sprintf("idle for %s", BeautifyDuration(d)))
+}
+
+func (self *watchdog) Active() {
+	atomic.StoreInt64(&self.last, time.Now().UnixNano())
+}
+
+func (self *watchdog) Stop() {
+	if self.timer != nil {
+		self.timer.Stop()
+	}
+	if self.lifetime != nil {
+		self.lifetime.Stop()
+	}
+}
+
+// Reader to mark the watchdog active on each read
+func (self *watchdog) Reader(r io.Reader) io.Reader {
+	if self.timer == nil {
+		return r
+	}
+	return &watchedReader{r: r, wd: self}
+}
+
+type watchedReader struct {
+	r  io.Reader
+	wd *watchdog
+}
+
+func (self *watchedReader) Read(b []byte) (int, error) {
+	n, err := self.r.Read(b)
+	if n > 0 {
+		self.wd.Active()
+	}
+	return n, err
+}
+
+// dial addr through the SSH client, which may be half dead and never answer
+func dialSSH(cli *ssh.Client, network, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return cli.Dial(network, addr)
+	}
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := cli.Dial(network, addr)
+		done <- result{c, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.c, res.err
+	case <-time.After(timeout):
+		go func() {
+			// close the channel opened too late
+			if res := <-done; res.c != nil {
+				res.c.Close()
+			}
+		}()
+		return nil, fmt.Errorf("ssh: open channel to %s: %w", addr, os.ErrDeadlineExceeded)
+	}
+}
+
+// dial with timeout if the context has no deadline
+func dialTimeout(d Dialer, network, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return d.Dial(network, addr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,231 @@
+package mallory
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// interval to save usage
+	usageSaveInterval = time.Minute
+	// days kept in usage, enough for this and the last month
+	usageKeepDays = 62
+	// layout of days in usage, months are the prefix of days
+	usageDayLayout   = "2006-01-02"
+	usageMonthLayout = "2006-01"
+)
+
+// Quota of a client through SSH remotes each month
+type Quota struct {
+	// bytes in both directions, zero for unlimited
+	Bytes int64
+	// connect directly once exceeded, or reject
+	Direct bool
+}
+
+// Bytes transferred by a client in a day
+type ClientUsage struct {
+	// from client to hosts
+	Sent int64 `json:"sent"`
+	// from hosts to client
+	Received int64 `json:"received"`
+	// both directions by route, e.g. DIRECT, PROXY or a remote
+	Routes map[string]int64 `json:"routes"`
+}
+
+// Usage counts bytes of each client per day, by authenticated user or client
+// IP, and saves them to file
+type Usage struct {
+	// clients by day
+	Days  map[string]map[string]*ClientUsage
+	path  string
+	dirty bool
+	mutex sync.Mutex
+}
+
+// Create empty usage, kept in memory only until opened
+func NewUsage() *Usage {
+	return &Usage{Days: make(map[string]map[string]*ClientUsage)}
+}
+
+// Open loads usage from path and saves it there periodically, called once
+func (self *Usage) Open(path string) error {
+	if err := self.load(path); err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	self.path = path
+	self.mutex.Unlock()
+	go func() {
+		for range time.Tick(usageSaveInterval) {
+			if err := self.Save(); err != nil {
+				L.Printf("Save usage %s: %s\n", path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// load usage from file, it's fine if the file does not exist
+func (self *Usage) load(path string) error {
+	days := make(map[string]map[string]*ClientUsage)
+	if err := loadJSON(path, &days); err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	self.Days = days
+	self.mutex.Unlock()
+	return nil
+}
+
+// Add n bytes of client through route today, sent to hosts or received
+func (self *Usage) Add(client, route string, sent bool, n int64) {
+	if n <= 0 {
+		return
+	}
+	day := time.Now().Format(usageDayLayout)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	clients := self.Days[day]
+	if clients == nil {
+		self.expire()
+		clients = make(map[string]*ClientUsage)
+		self.Days[day] = clients
+	}
+	cu := clients[client]
+	if cu == nil {
+		cu = &ClientUsage{Routes: make(map[string]int64)}
+		clients[client] = cu
+	}
+	if sent {
+		cu.Sent += n
+	} else {
+		cu.Received += n
+	}
+	cu.Routes[route] += n
+	self.dirty = true
+}
+
+// drop days too old
+func (self *Usage) expire() {
+	oldest := time.Now().AddDate(0, 0, -usageKeepDays).Format(usageDayLayout)
+	for day := range self.Days {
+		if day < oldest {
+			delete(self.Days, day)
+		}
+	}
+}
+
+// Get usage of client in days with the prefix, e.g. "2006-01" for a month
+// or "2006-01-02" for a day, with bytes of routes summed up
+func (self *Usage) Get(client, prefix string) ClientUsage {
+	sum := ClientUsage{Routes: make(map[string]int64)}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for day, clients := range self.Days {
+		cu := clients[client]
+		if cu == nil || !strings.HasPrefix(day, prefix) {
+			continue
+		}
+		sum.Sent += cu.Sent
+		sum.Received += cu.Received
+		for route, n := range cu.Routes {
+			sum.Routes[route] += n
+		}
+	}
+	return sum
+}
+
+// Sorted clients in days with the prefix
+func (self *Usage) Clients(prefix string) []string {
+	seen := make(map[string]bool)
+	self.mutex.Lock()
+	for day, clients := range self.Days {
+		if strings.HasPrefix(day, prefix) {
+			for client := range clients {
+				seen[client] = true
+			}
+		}
+	}
+	self.mutex.Unlock()
+	names := make([]string, 0, len(seen))
+	for client := range seen {
+		names = append(names, client)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Save usage to the opened file if changed
+func (self *Usage) Save() error {
+	self.mutex.Lock()
+	if self.path == "" || !self.dirty {
+		self.mutex.Unlock()
+		return nil
+	}
+	self.expire()
+	path := self.path
+	buf, err := json.MarshalIndent(self.Days, "", "  ")
+	self.dirty = false
+	self.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return saveFile(path, buf)
+}
+
+// Meter of bytes of client through route in one direction
+func (self *Usage) Meter(client, route string, sent bool) *Meter {
+	return &Meter{usage: self, client: client, route: route, sent: sent}
+}
+
+// Meter counts bytes into usage as they are transferred, nil to not count
+type Meter struct {
+	usage  *Usage
+	client string
+	route  string
+	sent   bool
+}
+
+// Add n bytes transferred
+func (self *Meter) Add(n int64) {
+	if self == nil {
+		return
+	}
+	self.usage.Add(self.client, self.route, self.sent, n)
+}
+
+// Reader returns r counted, or r as is if nil
+func (self *Meter) Reader(r io.Reader) io.Reader {
+	if self == nil {
+		return r
+	}
+	return &meteredReader{r: r, meter: self}
+}
+
+type meteredReader struct {
+	r     io.Reader
+	meter *Meter
+}
+
+func (self *meteredReader) Read(b []byte) (int, error) {
+	n, err := self.r.Read(b)
+	self.meter.Add(int64(n))
+	return n, err
+}
+
+// request body counted by add
+type meteredBody struct {
+	io.ReadCloser
+	add func(n int64)
+}
+
+func (self *meteredBody) Read(b []byte) (int, error) {
+	n, err := self.ReadCloser.Read(b)
+	self.add(int64(n))
+	return n, err
+}
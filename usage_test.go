@@ -0,0 +1,50 @@
+package mallory
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQuotaByClient(t *testing.T) {
+	srv := newTestServer(t, `"routes": {"ssh.example": "proxy"}, "monthly_quota_mb": 1, "users": {"alice": "a"}`)
+	// never dialed, the quota is checked first
+	srv.Remote = &SSH{}
+	srv.Usage.Add("127.0.0.1", AccessType(true).String(), false, 2<<20)
+
+	get := func(user, passwd string) int {
+		r := proxyAuthRequest("http://ssh.example/", user, passwd)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w.Code
+	}
+	// the quota of the IP is kept by any name
+	for _, user := range []string{"", "bob", "carol", "alice"} {
+		if code := get(user, "x"); code != http.StatusTooManyRequests {
+			t.Errorf("user %q: %d, want 429", user, code)
+		}
+	}
+	// the verified user has its own quota
+	if err := srv.exceeded("alice", srv.Remote); err != nil {
+		t.Errorf("alice: %s", err)
+	}
+	srv.Usage.Add("alice", AccessType(true).String(), true, 1<<20)
+	if err := srv.exceeded("alice", srv.Remote); err == nil {
+		t.Errorf("alice: quota is not exceeded")
+	}
+}
+
+func TestQuotaFallback(t *testing.T) {
+	srv := newTestServer(t, `"monthly_quota_mb": 1`)
+	// never dialed, the quota is checked first
+	srv.Remote = &SSH{}
+	srv.Usage.Add("127.0.0.1", AccessType(true).String(), false, 2<<20)
+
+	ctx := WithClient(context.Background(), "127.0.0.1")
+	c, err := srv.Direct.Fallback(ctx, "tcp", "blocked.example:443")
+	if _, ok := err.(*LimitError); !ok {
+		t.Errorf("fallback over the quota: %v, %v", c, err)
+	}
+}